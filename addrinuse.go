@@ -0,0 +1,35 @@
+//go:build !plan9
+// +build !plan9
+
+/*
+ *  b4ck-client
+ *  Copyright 2020 Michał Trojnara
+
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU General Public License as published by
+ *  the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU General Public License for more details.
+
+ *  You should have received a copy of the GNU General Public License
+ *  along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"errors"
+	"syscall"
+)
+
+// addrUnavailable reports whether dialing failed on the local address
+func addrUnavailable(err error) bool {
+	return errors.Is(err, syscall.EADDRINUSE) ||
+		errors.Is(err, syscall.EADDRNOTAVAIL)
+}
+
+// vim: noet:ts=4:sw=4:sts=4:spell
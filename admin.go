@@ -0,0 +1,118 @@
+/*
+ *  b4ck-client
+ *  Copyright 2020 Michał Trojnara
+
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU General Public License as published by
+ *  the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU General Public License for more details.
+
+ *  You should have received a copy of the GNU General Public License
+ *  along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"net"
+	"net/http"
+)
+
+// Status is the process state reported by the admin server
+type Status struct {
+	Remote         string  `json:"remote"`
+	Port           int     `json:"port"`
+	Local          string  `json:"local"`
+	Connections    uint64  `json:"connections"`
+	BytesSent      uint64  `json:"bytes_sent"`
+	BytesReceived  uint64  `json:"bytes_received"`
+	Quota          uint64  `json:"quota,omitempty"`
+	QuotaRemaining *uint64 `json:"quota_remaining,omitempty"`
+	Active         int     `json:"active_connections"`
+
+	Backends    []BackendStatus     `json:"backends"`
+	TLSSessions *SessionCacheStatus `json:"tls_sessions,omitempty"`
+}
+
+// startAdmin starts the HTTP admin server
+func (c *Context) startAdmin(addr string) error {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	c.active = NewConnRegistry()
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", c.handleMetrics)
+	mux.HandleFunc("/status", c.handleStatus)
+	mux.HandleFunc("/healthz", c.handleHealthz)
+	mux.HandleFunc("/connections.json", c.handleConnections)
+	mux.HandleFunc("/buildinfo", c.handleBuildInfo)
+	go func() {
+		err := http.Serve(listener, mux)
+		c.logger.Errorf("Admin server failed: %s", err)
+	}()
+	c.logger.Infof("Admin server listening on %s", listener.Addr())
+	return nil
+}
+
+func (c *Context) handleMetrics(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	err := metrics.WriteText(w)
+	if err != nil {
+		c.logger.Debugf("Failed to write metrics: %s", err)
+	}
+}
+
+func (c *Context) handleStatus(w http.ResponseWriter, r *http.Request) {
+	status := Status{
+		Remote:        c.raddr,
+		Port:          c.port,
+		Local:         c.laddr,
+		Connections:   metricConnections.Value(),
+		BytesSent:     metricSent.Value(),
+		BytesReceived: metricRcvd.Value(),
+		Active:        c.active.Len(),
+		Backends:      []BackendStatus{c.backend.Status()},
+	}
+	if c.tlsConfig != nil {
+		status.TLSSessions = sessionCacheStatus()
+	}
+	if c.routes != nil {
+		status.Backends = append(status.Backends, c.routes.statuses()...)
+	}
+	if c.quota != nil {
+		status.Quota = c.quota.limit
+		remaining := c.quota.Remaining()
+		status.QuotaRemaining = &remaining
+	}
+	writeJSON(w, &status)
+}
+
+// handleHealthz reports 200 if the -ready-on components are met
+func (c *Context) handleHealthz(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain")
+	if c.isReady() {
+		_, _ = w.Write([]byte("ok\n"))
+		return
+	}
+	w.WriteHeader(http.StatusServiceUnavailable)
+	_, _ = w.Write([]byte("not ready\n"))
+}
+
+// writeJSON sends v as an HTTP JSON response
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	body, err := json.Marshal(v)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_, _ = w.Write(append(body, '\n'))
+}
+
+// vim: noet:ts=4:sw=4:sts=4:spell
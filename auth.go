@@ -0,0 +1,77 @@
+/*
+ *  b4ck-client
+ *  Copyright 2020 Michał Trojnara
+
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU General Public License as published by
+ *  the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU General Public License for more details.
+
+ *  You should have received a copy of the GNU General Public License
+ *  along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"fmt"
+)
+
+// Authentication schemes
+const (
+	AuthRaw  = "raw"         // The key is sent in the listen message
+	AuthHMAC = "hmac-sha256" // The listen message proves the key with a MAC
+)
+
+// authenticate sends the listen message, preceded by a hello/challenge
+// exchange with the HMAC scheme:
+//
+//	client: {"Type":"hello","Auth":"hmac-sha256"}
+//	server: {"Type":"challenge","Nonce":...}
+//	client: {"Type":"listen","Auth":"hmac-sha256","Key":HMAC(key, nonce),...}
+func (c *Context) authenticate(s *Session) error {
+	logger, rconn := s.logger, s.rconn
+	listen := &Msg{Type: "listen", Port: c.port, Key: c.key, Tag: c.tag}
+	if c.syncFraming {
+		listen.Framing = FramingSync
+	}
+
+	if c.auth == AuthHMAC {
+		err := SndMsg(rconn, &Msg{Type: "hello", Auth: AuthHMAC})
+		if err != nil {
+			logger.Warningf("Failed to send HELLO: %s", err)
+			return backoff(9, "auth", err)
+		}
+		message, err := RcvMsg(rconn)
+		if err != nil {
+			logger.Warningf("Failed to receive CHALLENGE: %s", err)
+			return backoff(9, "auth", err)
+		}
+		if message.Type != "challenge" || len(message.Nonce) == 0 {
+			err = fmt.Errorf("unexpected %s message", message.Type)
+			logger.Warningf("HMAC authentication failed: %s", err)
+			return backoff(99, "auth", err)
+		}
+		mac := hmac.New(sha256.New, c.key)
+		mac.Write(message.Nonce)
+		listen.Auth = AuthHMAC
+		listen.Key = mac.Sum(nil)
+	}
+
+	// Send an authentication request
+	err := SndMsg(rconn, listen)
+	if err != nil {
+		logger.Warningf("Failed to send port number: %s", err)
+		return backoff(9, "listen", err)
+	}
+	return nil
+}
+
+// vim: noet:ts=4:sw=4:sts=4:spell
@@ -0,0 +1,101 @@
+/*
+ *  b4ck-client
+ *  Copyright 2020 Michał Trojnara
+
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU General Public License as published by
+ *  the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU General Public License for more details.
+
+ *  You should have received a copy of the GNU General Public License
+ *  along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Backend tracks the health of a local service
+type Backend struct {
+	active   int64 // Accessed atomically
+	addr     string
+	mu       sync.Mutex
+	lastDial time.Time
+	lastErr  error
+	failures int
+}
+
+// BackendStatus is the health of a Backend reported by the admin server
+type BackendStatus struct {
+	Addr                string    `json:"addr"`
+	Healthy             bool      `json:"healthy"`
+	LastDial            time.Time `json:"last_dial,omitempty"`
+	LastError           string    `json:"last_error,omitempty"`
+	ConsecutiveFailures int       `json:"consecutive_failures"`
+	ActiveConnections   int64     `json:"active_connections"`
+}
+
+// NewBackend returns a new Backend for the local service at addr
+func NewBackend(addr string) *Backend {
+	return &Backend{addr: addr}
+}
+
+// record updates the health with the result of a dial
+func (b *Backend) record(err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.lastDial = time.Now()
+	b.lastErr = err
+	if err == nil {
+		b.failures = 0
+	} else {
+		b.failures++
+	}
+}
+
+// acquire counts an active connection until the returned function is called
+func (b *Backend) acquire() func() {
+	atomic.AddInt64(&b.active, 1)
+	return func() { atomic.AddInt64(&b.active, -1) }
+}
+
+// Status returns the current health of the backend
+func (b *Backend) Status() BackendStatus {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	status := BackendStatus{
+		Addr:                b.addr,
+		Healthy:             b.failures == 0,
+		LastDial:            b.lastDial,
+		ConsecutiveFailures: b.failures,
+		ActiveConnections:   atomic.LoadInt64(&b.active),
+	}
+	if b.lastErr != nil {
+		status.LastError = b.lastErr.Error()
+	}
+	return status
+}
+
+// backendCheckTimeout limits the test connections to the local service
+const backendCheckTimeout = 10 * time.Second
+
+// checkBackend makes a test connection to the local service
+func (c *Context) checkBackend() error {
+	conn, err := c.dialLocalTimeout(c.logger, c.laddr, "", backendCheckTimeout)
+	c.backend.record(err)
+	if err != nil {
+		return err
+	}
+	return conn.Close()
+}
+
+// vim: noet:ts=4:sw=4:sts=4:spell
@@ -0,0 +1,56 @@
+/*
+ *  b4ck-client
+ *  Copyright 2020 Michał Trojnara
+
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU General Public License as published by
+ *  the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU General Public License for more details.
+
+ *  You should have received a copy of the GNU General Public License
+ *  along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"fmt"
+)
+
+var metricBackoffs = metrics.NewCounter("b4ck_backoffs_total", "Worker reconnection backoffs")
+
+// Backoff is a remote session failure delaying the reconnection
+type Backoff struct {
+	Delay  int    // Maximum random delay in seconds, added to 1 second
+	Reason string // Short machine-readable failure reason
+	Err    error
+}
+
+func backoff(delay int, reason string, err error) *Backoff {
+	return &Backoff{Delay: delay, Reason: reason, Err: err}
+}
+
+func (b *Backoff) Error() string {
+	return fmt.Sprintf("%s: %s", b.Reason, b.Err)
+}
+
+func (b *Backoff) Unwrap() error {
+	return b.Err
+}
+
+// emitBackoff reports a worker entering a backoff of ms milliseconds
+func (c *Context) emitBackoff(w *Worker, b *Backoff, ms int) {
+	metricBackoffs.Inc()
+	c.onBackoff.Run(w.logger,
+		fmt.Sprintf("B4CK_WORKER=%d", w.id),
+		"B4CK_REASON="+b.Reason,
+		"B4CK_ERROR="+b.Err.Error(),
+		fmt.Sprintf("B4CK_DELAY_MS=%d", ms))
+}
+
+// vim: noet:ts=4:sw=4:sts=4:spell
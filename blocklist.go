@@ -0,0 +1,125 @@
+/*
+ *  b4ck-client
+ *  Copyright 2020 Michał Trojnara
+
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU General Public License as published by
+ *  the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU General Public License for more details.
+
+ *  You should have received a copy of the GNU General Public License
+ *  along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"sync"
+)
+
+// Blocklist holds the source networks refused by local()
+type Blocklist struct {
+	path string
+	mu   sync.RWMutex
+	nets []*net.IPNet
+}
+
+// LoadBlocklist returns a new Blocklist read from a file
+func LoadBlocklist(path string) (*Blocklist, error) {
+	b := &Blocklist{path: path}
+	err := b.Reload()
+	if err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+// Reload replaces the list with the current file contents.
+// The file contains one IP address or CIDR network per line.
+// Empty lines and lines starting with '#' are ignored.
+func (b *Blocklist) Reload() error {
+	file, err := os.Open(b.path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	var nets []*net.IPNet
+	scanner := bufio.NewScanner(file)
+	for line := 1; scanner.Scan(); line++ {
+		entry := strings.TrimSpace(scanner.Text())
+		if entry == "" || strings.HasPrefix(entry, "#") {
+			continue
+		}
+		ipnet, err := parseNet(entry)
+		if err != nil {
+			return fmt.Errorf("%s:%d: %s", b.path, line, err)
+		}
+		nets = append(nets, ipnet)
+	}
+	err = scanner.Err()
+	if err != nil {
+		return err
+	}
+
+	b.mu.Lock()
+	b.nets = nets
+	b.mu.Unlock()
+	return nil
+}
+
+// Len returns the number of blocked networks
+func (b *Blocklist) Len() int {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	return len(b.nets)
+}
+
+// Blocked reports whether a "host:port" or "host" address is blocked
+func (b *Blocklist) Blocked(addr string) bool {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		host = addr
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return false
+	}
+
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	for _, ipnet := range b.nets {
+		if ipnet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// parseNet parses a CIDR network or a single IP address
+func parseNet(entry string) (*net.IPNet, error) {
+	if strings.Contains(entry, "/") {
+		_, ipnet, err := net.ParseCIDR(entry)
+		return ipnet, err
+	}
+	ip := net.ParseIP(entry)
+	if ip == nil {
+		return nil, fmt.Errorf("invalid IP address: %s", entry)
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		return &net.IPNet{IP: ip4, Mask: net.CIDRMask(32, 32)}, nil
+	}
+	return &net.IPNet{IP: ip, Mask: net.CIDRMask(128, 128)}, nil
+}
+
+// vim: noet:ts=4:sw=4:sts=4:spell
@@ -0,0 +1,64 @@
+/*
+ *  b4ck-client
+ *  Copyright 2020 Michał Trojnara
+
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU General Public License as published by
+ *  the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU General Public License for more details.
+
+ *  You should have received a copy of the GNU General Public License
+ *  along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"runtime"
+	"time"
+)
+
+// BuildInfo is the build and runtime information of the process
+type BuildInfo struct {
+	Version   string    `json:"version"`
+	Commit    string    `json:"commit"`
+	BuildDate string    `json:"build_date"`
+	GoVersion string    `json:"go_version"`
+	OS        string    `json:"os"`
+	Arch      string    `json:"arch"`
+	Started   time.Time `json:"started"`
+	Uptime    float64   `json:"uptime_seconds"`
+}
+
+// getBuildInfo returns the build information, with the runtime
+// information of a process started at started
+func getBuildInfo(started time.Time) BuildInfo {
+	return BuildInfo{
+		Version:   version,
+		Commit:    commit,
+		BuildDate: buildDate,
+		GoVersion: runtime.Version(),
+		OS:        runtime.GOOS,
+		Arch:      runtime.GOARCH,
+		Started:   started,
+		Uptime:    time.Since(started).Seconds(),
+	}
+}
+
+func (b BuildInfo) String() string {
+	return fmt.Sprintf("b4ck-client %s (commit %s, built %s, %s %s/%s)",
+		b.Version, b.Commit, b.BuildDate, b.GoVersion, b.OS, b.Arch)
+}
+
+func (c *Context) handleBuildInfo(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, getBuildInfo(c.started))
+}
+
+// vim: noet:ts=4:sw=4:sts=4:spell
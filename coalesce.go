@@ -0,0 +1,88 @@
+/*
+ *  b4ck-client
+ *  Copyright 2020 Michał Trojnara
+
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU General Public License as published by
+ *  the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU General Public License for more details.
+
+ *  You should have received a copy of the GNU General Public License
+ *  along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"io"
+	"sync"
+	"time"
+)
+
+// coalesceMax is the buffered size that triggers an immediate flush
+const coalesceMax = 4096
+
+// CoalescingWriter batches small writes into a single write issued at most
+// delay after the first buffered byte
+type CoalescingWriter struct {
+	mu    sync.Mutex
+	w     io.Writer
+	delay time.Duration
+	buf   []byte
+	timer *time.Timer
+	err   error // Sticky error of the last failed flush
+}
+
+// NewCoalescingWriter returns a CoalescingWriter wrapping w
+func NewCoalescingWriter(w io.Writer, delay time.Duration) *CoalescingWriter {
+	return &CoalescingWriter{w: w, delay: delay}
+}
+
+// Write buffers p; errors of delayed flushes are reported by later calls
+func (cw *CoalescingWriter) Write(p []byte) (int, error) {
+	cw.mu.Lock()
+	defer cw.mu.Unlock()
+	if cw.err != nil {
+		return 0, cw.err
+	}
+	cw.buf = append(cw.buf, p...)
+	if len(cw.buf) >= coalesceMax {
+		return len(p), cw.flush()
+	}
+	if cw.timer == nil {
+		cw.timer = time.AfterFunc(cw.delay, func() {
+			_ = cw.Flush()
+		})
+	}
+	return len(p), nil
+}
+
+// Flush writes the buffered data; it is a no-op on a nil writer
+func (cw *CoalescingWriter) Flush() error {
+	if cw == nil {
+		return nil
+	}
+	cw.mu.Lock()
+	defer cw.mu.Unlock()
+	return cw.flush()
+}
+
+func (cw *CoalescingWriter) flush() error {
+	if cw.timer != nil {
+		cw.timer.Stop()
+		cw.timer = nil
+	}
+	if len(cw.buf) == 0 || cw.err != nil {
+		return cw.err
+	}
+	_, cw.err = cw.w.Write(cw.buf)
+	cw.buf = cw.buf[:0]
+	return cw.err
+}
+
+// vim: noet:ts=4:sw=4:sts=4:spell
@@ -0,0 +1,354 @@
+/*
+ *  b4ck-client
+ *  Copyright 2020 Michał Trojnara
+
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU General Public License as published by
+ *  the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU General Public License for more details.
+
+ *  You should have received a copy of the GNU General Public License
+ *  along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/json-iterator/go"
+)
+
+// envNames holds the environment variables of the single-letter flags
+var envNames = map[string]string{
+	"r": "B4CK_REMOTE",
+	"l": "B4CK_LOCAL",
+	"k": "B4CK_KEY",
+	"d": "B4CK_LOG_LEVEL",
+	"t": "B4CK_NO_TLS",
+}
+
+// envName returns the environment variable corresponding to a flag
+func envName(name string) string {
+	if env, ok := envNames[name]; ok {
+		return env
+	}
+	return "B4CK_" + strings.ToUpper(strings.Replace(name, "-", "_", -1))
+}
+
+// actionFlags holds the flags selecting an action instead of a setting,
+// which are only taken from the command line
+var actionFlags = map[string]bool{
+	"version":     true,
+	"selftest":    true,
+	"print-addrs": true,
+}
+
+// configSources records where each setting not left at its default
+// was resolved from
+var configSources = make(map[string]string)
+
+// applyEnv sets the flags missing on the command line from the environment,
+// and lists the settings given with different values in both
+func applyEnv() ([]string, error) {
+	seen := make(map[string]bool)
+	flag.Visit(func(f *flag.Flag) { seen[f.Name] = true })
+	var conflicts []string
+	var err error
+	flag.VisitAll(func(f *flag.Flag) {
+		if err != nil || actionFlags[f.Name] {
+			return
+		}
+		value, ok := os.LookupEnv(envName(f.Name))
+		if seen[f.Name] {
+			if configSources[f.Name] == "" {
+				configSources[f.Name] = "command line"
+			}
+			if ok && envConflict(f, value) {
+				conflicts = append(conflicts, fmt.Sprintf(
+					"-%s on the %s overrides a different %s",
+					f.Name, configSources[f.Name], envName(f.Name)))
+			}
+			return
+		}
+		if !ok {
+			return
+		}
+		if e := flag.Set(f.Name, value); e != nil {
+			err = fmt.Errorf("%s: %s", envName(f.Name), e)
+		}
+		configSources[f.Name] = "environment"
+	})
+	return conflicts, err
+}
+
+// maxStdinConfig limits the configuration read from the standard input
+const maxStdinConfig = 64 << 10
+
+// applyStdin sets the flags missing on the command line from a JSON object
+// keyed by flag names, or from "NAME=value" lines with the environment
+// variable names, and lists the settings given with different values on
+// the command line
+func applyStdin(r io.Reader) ([]string, error) {
+	data, err := ioutil.ReadAll(io.LimitReader(r, maxStdinConfig+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(data) > maxStdinConfig {
+		return nil, fmt.Errorf("more than %d bytes", maxStdinConfig)
+	}
+	values, err := parseStdinConfig(data)
+	if err != nil {
+		return nil, err
+	}
+	seen := make(map[string]bool)
+	flag.Visit(func(f *flag.Flag) { seen[f.Name] = true })
+	var conflicts []string
+	for _, name := range sortedKeys(values) {
+		f := flag.Lookup(name)
+		if seen[name] {
+			if envConflict(f, values[name]) {
+				conflicts = append(conflicts, fmt.Sprintf(
+					"-%s on the command line overrides a different value on the standard input",
+					name))
+			}
+			continue
+		}
+		err = flag.Set(name, values[name])
+		if err != nil {
+			return nil, fmt.Errorf("-%s: %s", name, err)
+		}
+		configSources[name] = "standard input"
+	}
+	return conflicts, nil
+}
+
+// parseStdinConfig returns the settings of a JSON object or "NAME=value"
+// lines keyed by the flag names
+func parseStdinConfig(data []byte) (map[string]string, error) {
+	values := make(map[string]string)
+	text := strings.TrimSpace(string(data))
+	if strings.HasPrefix(text, "{") {
+		var object map[string]jsoniter.RawMessage
+		err := json.Unmarshal([]byte(text), &object)
+		if err != nil {
+			return nil, err
+		}
+		for name, raw := range object {
+			if flag.Lookup(name) == nil || actionFlags[name] {
+				return nil, fmt.Errorf("unknown setting %q", name)
+			}
+			var value string
+			if json.Unmarshal(raw, &value) != nil { // A number or boolean
+				value = string(raw)
+			}
+			values[name] = value
+		}
+		return values, nil
+	}
+	flags := make(map[string]string)
+	flag.VisitAll(func(f *flag.Flag) {
+		if !actionFlags[f.Name] {
+			flags[envName(f.Name)] = f.Name
+		}
+	})
+	for i, line := range strings.Split(text, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		t := strings.SplitN(strings.TrimPrefix(line, "export "), "=", 2)
+		if len(t) != 2 {
+			return nil, fmt.Errorf("line %d: missing \"=\"", i+1)
+		}
+		name, ok := flags[strings.TrimSpace(t[0])]
+		if !ok {
+			return nil, fmt.Errorf("line %d: unknown setting %q", i+1, t[0])
+		}
+		value := strings.TrimSpace(t[1])
+		if len(value) >= 2 && (value[0] == '"' || value[0] == '\'') &&
+			value[len(value)-1] == value[0] {
+			value = value[1 : len(value)-1]
+		}
+		values[name] = value
+	}
+	return values, nil
+}
+
+// envConflict reports whether value differs from the value set on the
+// command line, once both are parsed, e.g. "1" and "true" are equal
+func envConflict(f *flag.Flag, value string) bool {
+	getter, ok := f.Value.(flag.Getter)
+	if !ok {
+		return f.Value.String() != value
+	}
+	set := f.Value.String()
+	parsed := getter.Get()
+	// Restore the command line value, also reset by a failed Set
+	defer func() { _ = f.Value.Set(set) }()
+	if f.Value.Set(value) != nil {
+		return true
+	}
+	return getter.Get() != parsed
+}
+
+// sortedKeys returns the keys of m in alphabetical order
+func sortedKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// missingSettings lists the mandatory flags that have no resolved value
+func missingSettings(mandatory ...string) []string {
+	var missing []string
+	for _, name := range mandatory {
+		f := flag.Lookup(name)
+		if f.Value.String() == "" {
+			missing = append(missing,
+				fmt.Sprintf("%s (-%s or %s)",
+					strings.TrimSuffix(f.Usage, " (mandatory)"), name, envName(name)))
+		}
+	}
+	return missing
+}
+
+// serviceTag returns the tag mapped to the port of laddr by a
+// comma-separated list of "port=tag" entries
+func serviceTag(tags, laddr string) (string, error) {
+	_, lport, err := net.SplitHostPort(laddr)
+	if err != nil {
+		return "", err
+	}
+	port, err := net.LookupPort("tcp", lport)
+	if err != nil {
+		return "", err
+	}
+	for _, entry := range strings.Split(tags, ",") {
+		t := strings.SplitN(entry, "=", 2)
+		if len(t) != 2 || t[1] == "" {
+			return "", fmt.Errorf("invalid tag mapping: %s", entry)
+		}
+		p, err := net.LookupPort("tcp", t[0])
+		if err != nil {
+			return "", err
+		}
+		if p == port {
+			return t[1], nil
+		}
+	}
+	return "", nil
+}
+
+// printAddrs writes the addresses derived from the configuration, one
+// "name address" pair per line, resolved as dialing does: with resolver
+// (the system resolver if nil), and through the proxy chain if any, in
+// which case the last proxy resolves the remote address
+func printAddrs(w io.Writer, resolver *net.Resolver, relays []*Relay,
+	rnet, raddr string, port int, laddr string) error {
+	type entry struct {
+		name, network, addr string
+		resolve             bool
+	}
+	entries := []entry{{"remote", rnet, raddr, len(relays) == 0}}
+	if len(relays) > 0 {
+		entries = append(entries, entry{"proxy", rnet, relays[0].addr, true})
+	}
+	entries = append(entries, entry{"local", "tcp", laddr, true})
+	for _, a := range entries {
+		fmt.Fprintf(w, "%s %s\n", a.name, a.addr)
+		host, p, err := net.SplitHostPort(a.addr)
+		if err != nil {
+			return err
+		}
+		if host == "" || !a.resolve {
+			continue
+		}
+		addrs, err := resolver.LookupIPAddr(context.Background(), host)
+		if err != nil {
+			return err
+		}
+		for _, addr := range addrs {
+			if (a.network == "tcp4" && addr.IP.To4() == nil) ||
+				(a.network == "tcp6" && addr.IP.To4() != nil) {
+				continue
+			}
+			fmt.Fprintf(w, "%s-ip %s\n", a.name, net.JoinHostPort(addr.String(), p))
+		}
+	}
+	_, err := fmt.Fprintf(w, "port %d\n", port)
+	return err
+}
+
+// checkWritable verifies that a file can be created next to path; features
+// writing files are disabled with a warning when it fails, so the client
+// also runs on read-only filesystems
+func checkWritable(path string) error {
+	file, err := ioutil.TempFile(filepath.Dir(path), ".b4ck-check-*")
+	if err != nil {
+		return err
+	}
+	file.Close()
+	return os.Remove(file.Name())
+}
+
+// randomSeed returns the fixed seed from B4CK_SEED for reproducible
+// startup and backoff timing, or a time-based seed if it is not set
+func randomSeed(logger *Logger) int64 {
+	if s := os.Getenv("B4CK_SEED"); s != "" {
+		seed, err := strconv.ParseInt(s, 10, 64)
+		if err == nil {
+			logger.Infof("Using fixed random seed: %d", seed)
+			return seed
+		}
+		logger.Warningf("Invalid B4CK_SEED ignored: %s", s)
+	}
+	return time.Now().UnixNano()
+}
+
+// lockedSource is a rand.Source safe for concurrent use
+type lockedSource struct {
+	mu  sync.Mutex
+	src rand.Source
+}
+
+func (s *lockedSource) Int63() int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.src.Int63()
+}
+
+func (s *lockedSource) Seed(seed int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.src.Seed(seed)
+}
+
+// newRand returns a random number generator seeded with seed, safe for
+// concurrent use
+func newRand(seed int64) *rand.Rand {
+	return rand.New(&lockedSource{src: rand.NewSource(seed)})
+}
+
+// vim: noet:ts=4:sw=4:sts=4:spell
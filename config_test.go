@@ -0,0 +1,183 @@
+/*
+ *  b4ck-client
+ *  Copyright 2020 Michał Trojnara
+
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU General Public License as published by
+ *  the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU General Public License for more details.
+
+ *  You should have received a copy of the GNU General Public License
+ *  along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"bytes"
+	"flag"
+	"os"
+	"strings"
+	"testing"
+)
+
+// withFlags replaces the command line flags with -r, -k and -version
+// parsed from args, and returns a function restoring them
+func withFlags(t *testing.T, args []string) func() {
+	saved, savedSources := flag.CommandLine, configSources
+	flag.CommandLine = flag.NewFlagSet("test", flag.ContinueOnError)
+	configSources = make(map[string]string)
+	flag.String("r", "", "remote address (mandatory)")
+	flag.String("k", "", "authentication key (mandatory)")
+	flag.Bool("version", false, "print the version")
+	if err := flag.CommandLine.Parse(args); err != nil {
+		t.Fatalf("Parse failed: %s", err)
+	}
+	return func() { flag.CommandLine, configSources = saved, savedSources }
+}
+
+// setEnv sets the environment variables in env, and returns a function
+// removing them
+func setEnv(env map[string]string) func() {
+	for name, value := range env {
+		os.Setenv(name, value)
+	}
+	return func() {
+		for name := range env {
+			os.Unsetenv(name)
+		}
+	}
+}
+
+func TestMissingSettings(t *testing.T) {
+	tests := []struct {
+		name    string
+		args    []string
+		env     map[string]string
+		stdin   string
+		missing []string
+	}{
+		{"nothing", nil, nil, "", []string{"-r", "-k"}},
+		{"command line", []string{"-r", "host:80", "-k", "key"}, nil, "", nil},
+		{"remote on the command line", []string{"-r", "host:80"}, nil, "", []string{"-k"}},
+		{"key on the command line", []string{"-k", "key"}, nil, "", []string{"-r"}},
+		{"environment", nil,
+			map[string]string{"B4CK_REMOTE": "host:80", "B4CK_KEY": "key"}, "", nil},
+		{"remote in the environment", nil,
+			map[string]string{"B4CK_REMOTE": "host:80"}, "", []string{"-k"}},
+		{"key in the environment", nil,
+			map[string]string{"B4CK_KEY": "key"}, "", []string{"-r"}},
+		{"empty environment", nil,
+			map[string]string{"B4CK_REMOTE": "", "B4CK_KEY": ""}, "", []string{"-r", "-k"}},
+		{"standard input", nil, nil, `{"r": "host:80", "k": "key"}`, nil},
+		{"key on the standard input", nil, nil, "B4CK_KEY=key", []string{"-r"}},
+		{"all sources", []string{"-r", "host:80"},
+			map[string]string{"B4CK_KEY": "key"}, "B4CK_KEY=other", nil},
+	}
+	for _, test := range tests {
+		restore := withFlags(t, test.args)
+		unset := setEnv(test.env)
+		if test.stdin != "" {
+			if _, err := applyStdin(strings.NewReader(test.stdin)); err != nil {
+				t.Errorf("%s: applyStdin failed: %s", test.name, err)
+			}
+		}
+		if _, err := applyEnv(); err != nil {
+			t.Errorf("%s: applyEnv failed: %s", test.name, err)
+		}
+		missing := missingSettings("r", "k")
+		unset()
+		restore()
+
+		if len(missing) != len(test.missing) {
+			t.Errorf("%s: missing %q, expected %q", test.name, missing, test.missing)
+			continue
+		}
+		for i, m := range missing {
+			if !strings.Contains(m, "("+test.missing[i]+" or ") {
+				t.Errorf("%s: missing %q, expected %s", test.name, m, test.missing[i])
+			}
+			if strings.Contains(m, "(mandatory)") {
+				t.Errorf("%s: usage text repeated in %q", test.name, m)
+			}
+		}
+	}
+}
+
+func TestConflictInvalidValue(t *testing.T) {
+	defer withFlags(t, nil)()
+	flag.Int("workers", 1, "number of workers")
+	if err := flag.CommandLine.Parse([]string{"-workers", "5"}); err != nil {
+		t.Fatal(err)
+	}
+	defer setEnv(map[string]string{"B4CK_WORKERS": "abc"})()
+	conflicts, err := applyEnv()
+	if err != nil || len(conflicts) != 1 {
+		t.Errorf("Invalid B4CK_WORKERS reported %q: %v", conflicts, err)
+	}
+	conflicts, err = applyStdin(strings.NewReader("B4CK_WORKERS=abc"))
+	if err != nil || len(conflicts) != 1 {
+		t.Errorf("Invalid value on the standard input reported %q: %v", conflicts, err)
+	}
+	if v := flag.Lookup("workers").Value.String(); v != "5" {
+		t.Errorf("-workers 5 changed to %s by an invalid value", v)
+	}
+}
+
+func TestActionFlagsNotFromEnvironment(t *testing.T) {
+	defer withFlags(t, nil)()
+	defer setEnv(map[string]string{"B4CK_VERSION": "true"})()
+	if _, err := applyEnv(); err != nil {
+		t.Fatalf("applyEnv failed: %s", err)
+	}
+	if v := flag.Lookup("version").Value.String(); v != "false" {
+		t.Errorf("-version set to %s from the environment", v)
+	}
+	if _, err := applyStdin(strings.NewReader(`{"version": true}`)); err == nil {
+		t.Errorf("-version accepted on the standard input")
+	}
+}
+
+func TestNewRandSeed(t *testing.T) {
+	a, b := newRand(42), newRand(42)
+	for i := 0; i < 10; i++ {
+		if x, y := a.Int63(), b.Int63(); x != y {
+			t.Fatalf("Same seed returned %d and %d", x, y)
+		}
+	}
+}
+
+func TestPrintAddrs(t *testing.T) {
+	var buf bytes.Buffer
+	err := printAddrs(&buf, nil, nil, "tcp", "127.0.0.1:8080", 80, ":80")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := "remote 127.0.0.1:8080\nremote-ip 127.0.0.1:8080\nlocal :80\nport 80\n"
+	if buf.String() != expected {
+		t.Errorf("Printed %q, expected %q", buf.String(), expected)
+	}
+
+	// The last proxy resolves the remote address
+	relays, err := ParseRelayChain("socks5://127.0.0.1:1080")
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf.Reset()
+	err = printAddrs(&buf, nil, relays, "tcp", "server.invalid:8080", 80, "127.0.0.1:80")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected = "remote server.invalid:8080\nproxy 127.0.0.1:1080\nproxy-ip 127.0.0.1:1080\n" +
+		"local 127.0.0.1:80\nlocal-ip 127.0.0.1:80\nport 80\n"
+	if buf.String() != expected {
+		t.Errorf("Printed %q, expected %q", buf.String(), expected)
+	}
+}
+
+// vim: noet:ts=4:sw=4:sts=4:spell
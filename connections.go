@@ -0,0 +1,129 @@
+/*
+ *  b4ck-client
+ *  Copyright 2020 Michał Trojnara
+
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU General Public License as published by
+ *  the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU General Public License for more details.
+
+ *  You should have received a copy of the GNU General Public License
+ *  along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// ConnRegistry tracks the connections being forwarded
+type ConnRegistry struct {
+	mu    sync.Mutex
+	conns map[*ConnRecord]*Proxy
+}
+
+// ConnStatus is an active connection reported by the admin server
+type ConnStatus struct {
+	ID       uint64  `json:"id"`
+	Age      float64 `json:"age_seconds"`
+	Addr     string  `json:"source"`
+	Backend  string  `json:"backend"`
+	Dialed   string  `json:"dialed"`
+	Class    string  `json:"class"`
+	Sent     *int64  `json:"bytes_sent,omitempty"`     // With -live-bytes
+	Received *int64  `json:"bytes_received,omitempty"` // With -live-bytes
+
+	// Time since the last byte, with -live-bytes, and the last read
+	// deadline of each direction
+	IdleSent         *float64   `json:"idle_sent_seconds,omitempty"`
+	IdleReceived     *float64   `json:"idle_received_seconds,omitempty"`
+	SentDeadline     *time.Time `json:"sent_deadline,omitempty"`
+	ReceivedDeadline *time.Time `json:"received_deadline,omitempty"`
+}
+
+// ConnSnapshot is the /connections.json response
+type ConnSnapshot struct {
+	Time        time.Time    `json:"time"`
+	Connections []ConnStatus `json:"connections"`
+}
+
+// NewConnRegistry returns an empty ConnRegistry
+func NewConnRegistry() *ConnRegistry {
+	return &ConnRegistry{conns: make(map[*ConnRecord]*Proxy)}
+}
+
+// add registers a connection until the returned function is called;
+// it is a no-op on a nil ConnRegistry
+func (r *ConnRegistry) add(record *ConnRecord, p *Proxy) func() {
+	if r == nil {
+		return func() {}
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.conns[record] = p
+	return func() {
+		r.mu.Lock()
+		defer r.mu.Unlock()
+		delete(r.conns, record)
+	}
+}
+
+// Len returns the number of active connections
+func (r *ConnRegistry) Len() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return len(r.conns)
+}
+
+// Snapshot returns the active connections ordered by id
+func (r *ConnRegistry) Snapshot() *ConnSnapshot {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	now := time.Now()
+	conns := make([]ConnStatus, 0, len(r.conns))
+	for record, p := range r.conns {
+		state := p.State()
+		conns = append(conns, ConnStatus{
+			ID:               record.ID,
+			Age:              now.Sub(record.Start).Seconds(),
+			Addr:             record.Addr,
+			Backend:          record.Backend,
+			Dialed:           record.Dialed,
+			Class:            record.Class,
+			SentDeadline:     optionalTime(state.SentDeadline),
+			ReceivedDeadline: optionalTime(state.ReceivedDeadline),
+		})
+		if state.Live {
+			status := &conns[len(conns)-1]
+			status.Sent, status.Received = &state.Sent, &state.Received
+			idleSent := now.Sub(state.LastSent).Seconds()
+			idleReceived := now.Sub(state.LastReceived).Seconds()
+			status.IdleSent, status.IdleReceived = &idleSent, &idleReceived
+		}
+	}
+	sort.Slice(conns, func(i, j int) bool { return conns[i].ID < conns[j].ID })
+	return &ConnSnapshot{Time: now, Connections: conns}
+}
+
+// optionalTime returns nil for the zero time, omitting it from JSON
+func optionalTime(t time.Time) *time.Time {
+	if t.IsZero() {
+		return nil
+	}
+	return &t
+}
+
+func (c *Context) handleConnections(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, c.active.Snapshot())
+}
+
+// vim: noet:ts=4:sw=4:sts=4:spell
@@ -0,0 +1,57 @@
+/*
+ *  b4ck-client
+ *  Copyright 2020 Michał Trojnara
+
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU General Public License as published by
+ *  the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU General Public License for more details.
+
+ *  You should have received a copy of the GNU General Public License
+ *  along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+// snapshotJSON returns /connections.json with a single connection
+// forwarded by p
+func snapshotJSON(t *testing.T, p *Proxy) string {
+	t.Helper()
+	r := NewConnRegistry()
+	defer r.add(&ConnRecord{ID: 1, Start: time.Now()}, p)()
+	body, err := json.Marshal(r.Snapshot())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(body)
+}
+
+func TestSnapshotLiveFields(t *testing.T) {
+	p := GetProxy(GetLogger("test"), CloseSymmetric)
+	if body := snapshotJSON(t, p); strings.Contains(body, "bytes_") ||
+		strings.Contains(body, "idle_") {
+		t.Errorf("Bytes or idle times reported without -live-bytes: %s", body)
+	}
+	p.live = true
+	p.sent.bytes = 4
+	body := snapshotJSON(t, p)
+	if !strings.Contains(body, `"bytes_sent":4,"bytes_received":0`) {
+		t.Errorf("Bytes not reported with -live-bytes: %s", body)
+	}
+	if !strings.Contains(body, `"idle_sent_seconds":`) {
+		t.Errorf("Idle times not reported with -live-bytes: %s", body)
+	}
+}
+
+// vim: noet:ts=4:sw=4:sts=4:spell
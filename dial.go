@@ -0,0 +1,267 @@
+/*
+ *  b4ck-client
+ *  Copyright 2020 Michał Trojnara
+
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU General Public License as published by
+ *  the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU General Public License for more details.
+
+ *  You should have received a copy of the GNU General Public License
+ *  along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// PortRange is an inclusive range of source ports used in round-robin order
+type PortRange struct {
+	next  uint32 // Accessed atomically
+	first int
+	last  int
+}
+
+// ParsePortRange parses a "first-last" port range
+func ParsePortRange(s string) (*PortRange, error) {
+	t := strings.SplitN(s, "-", 2)
+	if len(t) != 2 {
+		return nil, fmt.Errorf("invalid port range: %s", s)
+	}
+	first, err := strconv.Atoi(t[0])
+	if err != nil {
+		return nil, fmt.Errorf("invalid port range: %s", s)
+	}
+	last, err := strconv.Atoi(t[1])
+	if err != nil {
+		return nil, fmt.Errorf("invalid port range: %s", s)
+	}
+	if first < 1 || last > 65535 || first > last {
+		return nil, fmt.Errorf("invalid port range: %s", s)
+	}
+	return &PortRange{first: first, last: last}, nil
+}
+
+func (r *PortRange) String() string {
+	return fmt.Sprintf("%d-%d", r.first, r.last)
+}
+
+// contains reports whether port is in the range
+func (r *PortRange) contains(port int) bool {
+	return port >= r.first && port <= r.last
+}
+
+// PortList is a set of port ranges
+type PortList []*PortRange
+
+// ParsePortList parses a comma-separated list of ports and port ranges
+func ParsePortList(s string) (PortList, error) {
+	var list PortList
+	for _, entry := range strings.Split(s, ",") {
+		entry = strings.TrimSpace(entry)
+		if !strings.Contains(entry, "-") {
+			entry += "-" + entry
+		}
+		r, err := ParsePortRange(entry)
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, r)
+	}
+	return list, nil
+}
+
+// contains reports whether port is in any of the ranges
+func (l PortList) contains(port int) bool {
+	for _, r := range l {
+		if r.contains(port) {
+			return true
+		}
+	}
+	return false
+}
+
+// take returns the next port in the range
+func (r *PortRange) take() int {
+	n := atomic.AddUint32(&r.next, 1) - 1
+	return r.first + int(n%uint32(r.last-r.first+1))
+}
+
+// dial connects addr from the next free source port in the range
+func (r *PortRange) dial(logger *Logger, dialer net.Dialer, addr string) (net.Conn, error) {
+	for i := r.first; i <= r.last; i++ {
+		port := r.take()
+		dialer.LocalAddr = &net.TCPAddr{Port: port}
+		conn, err := dialer.Dial("tcp", addr)
+		if err == nil {
+			return conn, nil
+		}
+		if !addrUnavailable(err) {
+			return nil, err
+		}
+		logger.Debugf("Source port %d unavailable: %s", port, err)
+	}
+	return nil, fmt.Errorf("no source port available in %s", r)
+}
+
+// newResolver returns a resolver querying the DNS server at addr, or over
+// DNS-over-TLS for "tls://" addresses; the port defaults to 53 or 853
+func newResolver(logger *Logger, addr string) (*net.Resolver, error) {
+	server, port, useTLS := addr, "53", false
+	if strings.HasPrefix(addr, "tls://") {
+		server, port, useTLS = strings.TrimPrefix(addr, "tls://"), "853", true
+	}
+	if _, _, err := net.SplitHostPort(server); err != nil {
+		server = net.JoinHostPort(strings.Trim(server, "[]"), port)
+	}
+	host, _, err := net.SplitHostPort(server)
+	if err != nil {
+		return nil, err
+	}
+	if net.ParseIP(host) == nil {
+		return nil, fmt.Errorf("resolver address is not an IP address: %s", host)
+	}
+	var dialer net.Dialer
+	return &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
+			logger.Debugf("Resolving via %s", addr)
+			if !useTLS {
+				return dialer.DialContext(ctx, network, server)
+			}
+			conn, err := dialer.DialContext(ctx, "tcp", server)
+			if err != nil {
+				return nil, err
+			}
+			// Not a PacketConn, so the resolver uses the TCP message format
+			return tls.Client(conn, &tls.Config{ServerName: host}), nil
+		},
+	}, nil
+}
+
+// chainControl returns a Dialer.Control function calling a and b, either
+// of which may be nil
+func chainControl(a, b func(string, string, syscall.RawConn) error) func(string, string, syscall.RawConn) error {
+	if a == nil {
+		return b
+	}
+	if b == nil {
+		return a
+	}
+	return func(network, address string, rc syscall.RawConn) error {
+		err := a(network, address, rc)
+		if err != nil {
+			return err
+		}
+		return b(network, address, rc)
+	}
+}
+
+// acquireLocalDial waits up to localDialWait for a local dial slot, if
+// the number of concurrent local dials is limited
+func (c *Context) acquireLocalDial() (release func(), ok bool) {
+	if c.localDials == nil {
+		return func() {}, true
+	}
+	timer := time.NewTimer(c.localDialWait)
+	defer timer.Stop()
+	select {
+	case c.localDials <- struct{}{}:
+		return func() { <-c.localDials }, true
+	case <-timer.C:
+		return nil, false
+	}
+}
+
+// errLocalDialSlot reports that no local dial slot was free in time
+var errLocalDialSlot = errors.New("no local dial slot")
+
+// dialLocalRetry calls dialLocal up to localDialAttempts times, waiting
+// the retry delay plus a random jitter between the attempts; a local dial
+// slot is only held during each attempt, not while waiting
+func (c *Context) dialLocalRetry(logger *Logger, addr, sni string) (net.Conn, error) {
+	for attempt := 1; ; attempt++ {
+		release, ok := c.acquireLocalDial()
+		if !ok {
+			return nil, errLocalDialSlot
+		}
+		conn, err := c.dialLocal(logger, addr, sni)
+		release()
+		if err == nil || attempt >= c.localDialAttempts {
+			return conn, err
+		}
+		delay := c.localDialDelay
+		if c.localDialJitter > 0 {
+			delay += time.Duration(c.rand.Int63n(int64(c.localDialJitter)))
+		}
+		logger.Infof("Local connection attempt %d failed, retrying in %s: %s",
+			attempt, delay, err)
+		time.Sleep(delay)
+	}
+}
+
+// dialLocal connects the local service at addr for a client that sent sni
+func (c *Context) dialLocal(logger *Logger, addr, sni string) (net.Conn, error) {
+	return c.dialLocalTimeout(logger, addr, sni, 0)
+}
+
+// dialLocalTimeout is dialLocal limiting both the dial and the TLS
+// handshake to timeout, if not 0
+func (c *Context) dialLocalTimeout(logger *Logger, addr, sni string, timeout time.Duration) (net.Conn, error) {
+	dialer := c.dialer
+	handshake := time.Minute
+	if timeout > 0 {
+		dialer.Timeout = timeout
+		handshake = timeout
+	}
+	conn, err := c.faults.Dial(func() (net.Conn, error) {
+		if c.localPorts != nil {
+			return c.localPorts.dial(logger, dialer, addr)
+		}
+		return dialer.Dial("tcp", addr)
+	})
+	if err != nil || c.localTLS == nil {
+		return conn, err
+	}
+
+	// Negotiate TLS with the local service
+	err = conn.SetDeadline(time.Now().Add(handshake))
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	config := c.localTLS
+	if name := c.serverNameFor(addr, sni); name != config.ServerName {
+		config = config.Clone()
+		config.ServerName = name
+	}
+	tlsConn := tls.Client(conn, config)
+	err = c.faults.Handshake()
+	if err == nil {
+		err = tlsConn.Handshake()
+	}
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("TLS handshake failed: %w", err)
+	}
+	logger.Debugf("Local %s connection", tlsSummary(tlsConn))
+	return tlsConn, nil
+}
+
+// vim: noet:ts=4:sw=4:sts=4:spell
@@ -0,0 +1,67 @@
+/*
+ *  b4ck-client
+ *  Copyright 2020 Michał Trojnara
+
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU General Public License as published by
+ *  the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU General Public License for more details.
+
+ *  You should have received a copy of the GNU General Public License
+ *  along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestDialLocalRetryReleasesSlot(t *testing.T) {
+	// A closed port refuses the connections
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := listener.Addr().String()
+	listener.Close()
+
+	c := &Context{
+		localDials:        make(chan struct{}, 1),
+		localDialWait:     100 * time.Millisecond,
+		localDialAttempts: 2,
+		localDialDelay:    time.Second,
+	}
+	failed := make(chan error, 1)
+	go func() {
+		_, err := c.dialLocalRetry(GetLogger("test"), addr, "")
+		failed <- err
+	}()
+
+	// The slot is free while the first attempt waits for the retry
+	time.Sleep(200 * time.Millisecond)
+	release, ok := c.acquireLocalDial()
+	if !ok {
+		t.Fatal("Local dial slot held between the attempts")
+	}
+	release()
+	if err := <-failed; err == nil || err == errLocalDialSlot {
+		t.Errorf("Dial of a closed port returned %v", err)
+	}
+
+	// Each attempt waits for a slot
+	release, _ = c.acquireLocalDial()
+	defer release()
+	if _, err := c.dialLocalRetry(GetLogger("test"), addr, ""); err != errLocalDialSlot {
+		t.Errorf("Dial without a free slot returned %v", err)
+	}
+}
+
+// vim: noet:ts=4:sw=4:sts=4:spell
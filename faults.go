@@ -0,0 +1,130 @@
+/*
+ *  b4ck-client
+ *  Copyright 2020 Michał Trojnara
+
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU General Public License as published by
+ *  the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU General Public License for more details.
+
+ *  You should have received a copy of the GNU General Public License
+ *  along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Faults injects random connection failures for testing the recovery
+// paths; it is only enabled with the B4CK_FAULTS environment variable
+type Faults struct {
+	dial      float64 // Probability of a failed dial
+	handshake float64 // Probability of a failed TLS handshake
+	reset     float64 // Probability of a reset, per read
+	slow      float64 // Probability of a delayed read
+	delay     time.Duration
+
+	rand *rand.Rand // Seeded with B4CK_SEED, see randomSeed
+}
+
+var errInjected = errors.New("injected fault")
+
+// ParseFaults parses comma-separated NAME=VALUE settings, e.g.
+// "dial=0.1,handshake=0.05,reset=0.01,slow=0.1,delay=2s", of faults
+// drawn from r
+func ParseFaults(s string, r *rand.Rand) (*Faults, error) {
+	f := &Faults{delay: time.Second, rand: r}
+	for _, item := range strings.Split(s, ",") {
+		t := strings.SplitN(strings.TrimSpace(item), "=", 2)
+		if len(t) != 2 {
+			return nil, fmt.Errorf("invalid fault: %s", item)
+		}
+		if t[0] == "delay" {
+			d, err := time.ParseDuration(t[1])
+			if err != nil || d < 0 {
+				return nil, fmt.Errorf("invalid fault delay: %s", t[1])
+			}
+			f.delay = d
+			continue
+		}
+		p, err := strconv.ParseFloat(t[1], 64)
+		if err != nil || p < 0 || p > 1 {
+			return nil, fmt.Errorf("invalid fault probability: %s", item)
+		}
+		switch t[0] {
+		case "dial":
+			f.dial = p
+		case "handshake":
+			f.handshake = p
+		case "reset":
+			f.reset = p
+		case "slow":
+			f.slow = p
+		default:
+			return nil, fmt.Errorf("unknown fault: %s", t[0])
+		}
+	}
+	return f, nil
+}
+
+// hit reports whether a fault with probability p occurs
+func (f *Faults) hit(p float64) bool {
+	return p > 0 && f.rand.Float64() < p
+}
+
+// Dial calls dial, failing it or wrapping the returned connection with
+// injected faults; it is a plain call to dial on a nil Faults
+func (f *Faults) Dial(dial func() (net.Conn, error)) (net.Conn, error) {
+	if f == nil {
+		return dial()
+	}
+	if f.hit(f.dial) {
+		return nil, fmt.Errorf("dial: %w", errInjected)
+	}
+	conn, err := dial()
+	if err != nil || (f.reset == 0 && f.slow == 0) {
+		return conn, err
+	}
+	return &faultConn{Conn: conn, f: f}, nil
+}
+
+// Handshake returns an injected TLS handshake error, if any
+func (f *Faults) Handshake() error {
+	if f != nil && f.hit(f.handshake) {
+		return fmt.Errorf("handshake: %w", errInjected)
+	}
+	return nil
+}
+
+// faultConn is a connection with injected read delays and resets
+type faultConn struct {
+	net.Conn
+	f *Faults
+}
+
+func (c *faultConn) Read(b []byte) (int, error) {
+	if c.f.hit(c.f.slow) {
+		time.Sleep(c.f.delay)
+	}
+	if c.f.hit(c.f.reset) {
+		reset(c.Conn)
+		c.Conn.Close()
+		return 0, fmt.Errorf("read: %w", errInjected)
+	}
+	return c.Conn.Read(b)
+}
+
+// vim: noet:ts=4:sw=4:sts=4:spell
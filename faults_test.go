@@ -0,0 +1,43 @@
+/*
+ *  b4ck-client
+ *  Copyright 2020 Michał Trojnara
+
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU General Public License as published by
+ *  the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU General Public License for more details.
+
+ *  You should have received a copy of the GNU General Public License
+ *  along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"testing"
+)
+
+func TestFaultsReplaySeed(t *testing.T) {
+	var hits [2][]bool
+	for i := range hits {
+		f, err := ParseFaults("dial=0.5", newRand(42))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for j := 0; j < 32; j++ {
+			hits[i] = append(hits[i], f.hit(f.dial))
+		}
+	}
+	for j := range hits[0] {
+		if hits[0][j] != hits[1][j] {
+			t.Fatalf("Fault %d differs with the same seed", j)
+		}
+	}
+}
+
+// vim: noet:ts=4:sw=4:sts=4:spell
@@ -0,0 +1,63 @@
+/*
+ *  b4ck-client
+ *  Copyright 2020 Michał Trojnara
+
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU General Public License as published by
+ *  the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU General Public License for more details.
+
+ *  You should have received a copy of the GNU General Public License
+ *  along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"fmt"
+	"runtime/debug"
+)
+
+var metricPanics = metrics.NewCounter("b4ck_panics_total", "Recovered goroutine panics")
+
+// guard recovers a panic of the goroutine deferring it, and logs it with
+// a stack trace; err, if set, receives a backoff error.  With -fail-fast
+// the panic is not recovered and terminates the process.
+func (c *Context) guard(logger *Logger, name string, err *error) {
+	if c.failFast {
+		return
+	}
+	r := recover()
+	if r == nil {
+		return
+	}
+	metricPanics.Inc()
+	logger.Errorf("Recovered from panic in %s: %v\n%s", name, r, debug.Stack())
+	if err != nil {
+		*err = backoff(99, "panic", fmt.Errorf("%v", r))
+	}
+}
+
+// session runs a single remote session of a worker
+func (c *Context) session(w *Worker) (err error) {
+	defer c.guard(w.logger, "worker", &err)
+	return c.remote(false, w)
+}
+
+// prewarm runs a fast connection
+func (c *Context) prewarm() {
+	defer c.guard(c.logger, "fast connection", nil)
+	if queued := c.prewarmLimit.wait(); queued == 1 {
+		c.logger.Infof("Startup prewarm cap reached, delaying fast connections")
+	} else if queued > 1 {
+		c.logger.Debugf("Delayed startup prewarm (%d total)", queued)
+	}
+	_ = c.remote(true, nil)
+}
+
+// vim: noet:ts=4:sw=4:sts=4:spell
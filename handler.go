@@ -0,0 +1,230 @@
+/*
+ *  b4ck-client
+ *  Copyright 2020 Michał Trojnara
+
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU General Public License as published by
+ *  the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU General Public License for more details.
+
+ *  You should have received a copy of the GNU General Public License
+ *  along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"fmt"
+	"net"
+	"time"
+)
+
+// Session holds the state of a single remote control connection
+type Session struct {
+	c       *Context
+	logger  *Logger
+	rconn   net.Conn
+	fast    bool
+	ropen   bool
+	worker  *Worker
+	started time.Time
+
+	keepalives int
+	out        *CoalescingWriter // nil unless control writes are coalesced
+}
+
+// receive reads a control message from the server
+func (s *Session) receive() (*Msg, error) {
+	if s.c.tolerantFraming && !s.c.syncFraming {
+		message, unprefixed, err := RcvTolerantMsg(s.rconn)
+		if unprefixed {
+			s.logger.Warningf("Received a message without the length prefix")
+		}
+		return message, err
+	}
+	if !s.c.syncFraming {
+		return RcvMsg(s.rconn)
+	}
+	message, skipped, err := RcvSyncMsg(s.rconn)
+	if skipped > 0 {
+		metricResyncBytes.Add(uint64(skipped))
+		s.logger.Warningf("Skipped %d bytes of corrupted input", skipped)
+	}
+	return message, err
+}
+
+// send writes a control message to the server
+func (s *Session) send(m *Msg) error {
+	if s.out != nil {
+		return SndMsg(s.out, m)
+	}
+	return SndMsg(s.rconn, m)
+}
+
+// Handler processes a server message; it returns true to end the message
+// loop, in which case a *Backoff error delays the reconnection
+type Handler func(s *Session, message *Msg) (done bool, err error)
+
+var handlers = make(map[string]Handler)
+
+var (
+	metricUnknownMessages = metrics.NewCounter("b4ck_unknown_messages_total",
+		"Server messages of unknown type")
+	metricResyncBytes = metrics.NewCounter("b4ck_resync_bytes_total",
+		"Corrupted bytes skipped to resynchronize sync framing")
+)
+
+// RegisterHandler installs the handler for a server message type
+func RegisterHandler(msgType string, handler Handler) {
+	handlers[msgType] = handler
+}
+
+func init() {
+	RegisterHandler("start", handleStart)
+	RegisterHandler("keepalive", handleKeepalive)
+	RegisterHandler("pool", handlePool)
+	RegisterHandler("debug", handleDebug)
+	RegisterHandler("info", handleInfo)
+	RegisterHandler("warning", handleWarning)
+	RegisterHandler("error", handleError)
+}
+
+// dispatch passes the message to its registered handler
+func (s *Session) dispatch(message *Msg) (bool, error) {
+	handler, ok := handlers[message.Type]
+	if !ok {
+		handler = handleDefault
+	}
+	return handler(s, message)
+}
+
+func handleStart(s *Session, message *Msg) (bool, error) {
+	if !s.worker.detach() { // Stopped by the pool
+		return true, nil
+	}
+	s.worker.touch()
+	err := s.out.Flush() // local() writes rconn directly
+	if err != nil {
+		s.logger.Warningf("Failed to send buffered messages: %s", err)
+		return true, backoff(9, "send", err)
+	}
+	s.ropen = false // rconn will be closed by local()
+	go s.c.local(s.logger, message, s.rconn)
+	if s.fast { // Keep a steady pool of fast connections
+		go s.c.prewarm()
+	}
+	return true, nil
+}
+
+func handleKeepalive(s *Session, message *Msg) (bool, error) {
+	s.logger.Debugf("Received KEEPALIVE")
+	if s.fast {
+		if token := s.c.timeoutToken; token != "" {
+			err := s.send(&Msg{Type: "info", Text: token})
+			if err != nil {
+				s.logger.Warningf("Failed to send %s: %s", token, err)
+			}
+		}
+		return true, nil
+	}
+	lifetime := s.c.slowMaxLifetime
+	if lifetime > 0 && time.Since(s.started) >= lifetime {
+		s.logger.Debugf("Recycling slow connection after %s", lifetime)
+		return true, nil
+	}
+	if max := s.c.maxKeepalives; max > 0 && s.keepalives >= max {
+		s.logger.Debugf("Recycling slow connection after %d keepalives", max)
+		return true, nil
+	}
+	s.keepalives++
+	if p := s.c.debugKeepaliveSkip; p > 0 && s.c.rand.Float64() < p {
+		s.logger.Infof("Not responding to KEEPALIVE (-debug-keepalive-skip)")
+		return false, nil
+	}
+	if d := s.c.debugKeepaliveDelay; d > 0 {
+		s.logger.Infof("Delaying KEEPALIVE response by %s (-debug-keepalive-delay)", d)
+		time.Sleep(d)
+	}
+	err := s.send(&Msg{Type: "keepalive"})
+	if err != nil {
+		s.logger.Warningf("Failed to send KEEPALIVE: %s", err)
+		return true, backoff(9, "keepalive", err)
+	}
+	err = s.rconn.SetDeadline(time.Now().Add(s.c.keepaliveDeadline))
+	if err != nil {
+		s.logger.Warningf("SetDeadline failed: %s", err)
+		return true, backoff(9, "deadline", err)
+	}
+	return false, nil
+}
+
+// handlePool applies the pool size hinted by the server within the
+// configured bounds, if enabled with -server-pool-size
+func handlePool(s *Session, message *Msg) (bool, error) {
+	if !s.c.serverPoolSize {
+		s.logger.Debugf("Ignored pool size hint: %d", message.Workers)
+		return false, nil
+	}
+	size := message.Workers
+	if size < s.c.pool.min {
+		size = s.c.pool.min
+	}
+	if size > s.c.poolMax {
+		size = s.c.poolMax
+	}
+	if size != message.Workers {
+		s.logger.Infof("Server pool size hint %d clamped to %d", message.Workers, size)
+	}
+	s.c.pool.resize(size)
+	return false, nil
+}
+
+func handleDebug(s *Session, message *Msg) (bool, error) {
+	if s.c.serverLog["debug"] {
+		s.logger.Debugf("%s", message.Text)
+	}
+	return !s.c.infoContinue, nil
+}
+
+func handleInfo(s *Session, message *Msg) (bool, error) {
+	if s.c.serverLog["info"] {
+		s.logger.Infof("%s", message.Text)
+	}
+	return !s.c.infoContinue, nil
+}
+
+func handleWarning(s *Session, message *Msg) (bool, error) {
+	if s.c.serverLog["warning"] {
+		s.logger.Warningf("%s", message.Text)
+	}
+	return !s.c.infoContinue, nil
+}
+
+func handleError(s *Session, message *Msg) (bool, error) {
+	text := ""
+	if s.c.serverLog["error"] {
+		text = fmt.Sprintf(" %q", message.Text)
+	}
+	s.logger.Errorf("Server error%s from %s (%s, tunnel %s), exiting",
+		text, s.rconn.RemoteAddr(), tlsSummary(s.rconn), s.c.tunnel)
+	s.c.exit(ExitServer)
+	return true, nil
+}
+
+func handleDefault(s *Session, message *Msg) (bool, error) {
+	metricUnknownMessages.Inc()
+	if s.c.unknownRecycle {
+		s.logger.Warningf("Unknown message, recycling connection: %s: %s",
+			message.Type, message.Text)
+		return true, nil
+	}
+	s.logger.Warningf("Ignored message: %s: %s", message.Type, message.Text)
+	return false, nil
+}
+
+// vim: noet:ts=4:sw=4:sts=4:spell
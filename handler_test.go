@@ -0,0 +1,65 @@
+/*
+ *  b4ck-client
+ *  Copyright 2020 Michał Trojnara
+
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU General Public License as published by
+ *  the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU General Public License for more details.
+
+ *  You should have received a copy of the GNU General Public License
+ *  along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"testing"
+)
+
+func TestDispatchUnknownType(t *testing.T) {
+	for _, recycle := range []bool{false, true} {
+		s := &Session{
+			c:      &Context{unknownRecycle: recycle},
+			logger: GetLogger("test"),
+		}
+		before := metricUnknownMessages.Value()
+		done, err := s.dispatch(&Msg{Type: "no-such-type"})
+		if err != nil {
+			t.Errorf("Unknown message failed: %s", err)
+		}
+		if done != recycle {
+			t.Errorf("Unknown message done %t with -unknown-msg recycle %t", done, recycle)
+		}
+		if n := metricUnknownMessages.Value() - before; n != 1 {
+			t.Errorf("Unknown message counted %d times", n)
+		}
+	}
+}
+
+func TestDispatchRegistered(t *testing.T) {
+	var received *Msg
+	RegisterHandler("test", func(s *Session, message *Msg) (bool, error) {
+		received = message
+		return true, nil
+	})
+	defer delete(handlers, "test")
+
+	s := &Session{c: &Context{}, logger: GetLogger("test")}
+	before := metricUnknownMessages.Value()
+	message := &Msg{Type: "test"}
+	done, err := s.dispatch(message)
+	if !done || err != nil || received != message {
+		t.Errorf("Registered handler not called: done %t, error %v", done, err)
+	}
+	if metricUnknownMessages.Value() != before {
+		t.Errorf("Registered message counted as unknown")
+	}
+}
+
+// vim: noet:ts=4:sw=4:sts=4:spell
@@ -0,0 +1,153 @@
+/*
+ *  b4ck-client
+ *  Copyright 2020 Michał Trojnara
+
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU General Public License as published by
+ *  the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU General Public License for more details.
+
+ *  You should have received a copy of the GNU General Public License
+ *  along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"os"
+	"os/exec"
+	"sync/atomic"
+	"time"
+)
+
+var metricHooksDropped = metrics.NewCounter("b4ck_hook_events_dropped_total",
+	"Hook events dropped because the hook queue was full")
+
+// Hook asynchronously runs an external program on connection events.
+// The number of started programs is limited to rate per second.
+type Hook struct {
+	path   string
+	tokens chan struct{}
+	queue  *HookQueue
+}
+
+// NewHook returns a new Hook running the program at path
+func NewHook(path string, rate int, queue *HookQueue) *Hook {
+	h := &Hook{
+		path:   path,
+		tokens: make(chan struct{}, rate),
+		queue:  queue,
+	}
+	for i := 0; i < rate; i++ {
+		h.tokens <- struct{}{}
+	}
+	go h.refill(time.Second / time.Duration(rate))
+	return h
+}
+
+func (h *Hook) refill(interval time.Duration) {
+	for range time.Tick(interval) {
+		select {
+		case h.tokens <- struct{}{}:
+		default: // The bucket is full
+		}
+	}
+}
+
+// Run queues the program with additional "NAME=value" environment variables
+func (h *Hook) Run(logger *Logger, env ...string) {
+	if h == nil {
+		return
+	}
+	select {
+	case <-h.tokens:
+	default:
+		logger.Warningf("Hook %s skipped: rate limit exceeded", h.path)
+		return
+	}
+	h.queue.push(&hookJob{hook: h, logger: logger, env: env})
+}
+
+type hookJob struct {
+	hook   *Hook
+	logger *Logger
+	env    []string
+}
+
+func (j *hookJob) run() {
+	cmd := exec.Command(j.hook.path)
+	cmd.Env = append(os.Environ(), j.env...)
+	err := cmd.Run()
+	if err != nil {
+		j.logger.Warningf("Hook %s failed: %s", j.hook.path, err)
+	} else {
+		j.logger.Debugf("Hook %s succeeded", j.hook.path)
+	}
+}
+
+// HookQueue runs the queued hook programs on a fixed number of workers.
+// Events are dropped rather than blocking the caller when the queue is full.
+type HookQueue struct {
+	pending int64 // Queued or running events, accessed atomically
+	logger  *Logger
+	jobs    chan *hookJob
+}
+
+// NewHookQueue returns a new HookQueue holding up to depth events
+func NewHookQueue(logger *Logger, depth, workers int) *HookQueue {
+	q := &HookQueue{
+		logger: logger,
+		jobs:   make(chan *hookJob, depth),
+	}
+	for i := 0; i < workers; i++ {
+		go q.work()
+	}
+	go q.report(time.Minute)
+	return q
+}
+
+func (q *HookQueue) push(job *hookJob) {
+	atomic.AddInt64(&q.pending, 1)
+	select {
+	case q.jobs <- job:
+	default:
+		atomic.AddInt64(&q.pending, -1)
+		metricHooksDropped.Inc()
+	}
+}
+
+func (q *HookQueue) work() {
+	for job := range q.jobs {
+		job.run()
+		atomic.AddInt64(&q.pending, -1)
+	}
+}
+
+// Flush waits until the queued events are run or the deadline passes, and
+// returns the number of events left; it is a no-op on a nil HookQueue
+func (q *HookQueue) Flush(deadline time.Time) int {
+	if q == nil {
+		return 0
+	}
+	return waitPending(&q.pending, deadline)
+}
+
+// report periodically warns about dropped events
+func (q *HookQueue) report(interval time.Duration) {
+	var reported uint64
+	for range time.Tick(interval) {
+		dropped := metricHooksDropped.Value()
+		if dropped > reported {
+			q.logger.Warningf("Dropped %d hook events (%d total): queue full",
+				dropped-reported, dropped)
+			reported = dropped
+		}
+	}
+}
+
+// vim: noet:ts=4:sw=4:sts=4:spell
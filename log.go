@@ -20,11 +20,16 @@ package main
 
 import (
 	"fmt"
+	"io"
 	"log"
 	"os"
 	"path"
 	"runtime"
+	"strconv"
 	"strings"
+	"sync/atomic"
+	"time"
+	"unicode/utf8"
 
 	"github.com/fatih/color"
 )
@@ -35,6 +40,7 @@ const (
 	WARNING
 	INFO
 	DEBUG
+	TRACE
 )
 
 type Level int
@@ -51,11 +57,31 @@ func (level Level) String() string {
 		return color.HiBlueString("INFO")
 	case DEBUG:
 		return color.HiGreenString("DEBUG")
+	case TRACE:
+		return color.HiWhiteString("TRACE")
 	default:
 		return color.HiMagentaString("INVALID")
 	}
 }
 
+// Name returns the level name without colors
+func (level Level) Name() string {
+	switch level {
+	case ERROR:
+		return "error"
+	case WARNING:
+		return "warning"
+	case INFO:
+		return "info"
+	case DEBUG:
+		return "debug"
+	case TRACE:
+		return "trace"
+	default:
+		return "unspecified"
+	}
+}
+
 // Currently unused
 func (level Level) Color() *color.Color {
 	switch level {
@@ -69,6 +95,8 @@ func (level Level) Color() *color.Color {
 		return color.New(color.FgBlue)
 	case DEBUG:
 		return color.New(color.FgGreen)
+	case TRACE:
+		return color.New(color.FgWhite)
 	default:
 		return color.New(color.FgCyan)
 	}
@@ -84,6 +112,8 @@ func ParseLevel(level string) (Level, bool) {
 		return INFO, true
 	case "DEBUG":
 		return DEBUG, true
+	case "TRACE":
+		return TRACE, true
 	default:
 		return UNSPECIFIED, false
 	}
@@ -91,20 +121,37 @@ func ParseLevel(level string) (Level, bool) {
 
 type Logger struct {
 	name   string
-	level  Level
+	level  *int32 // Shared with child loggers
+	maxLen int
+	logfmt bool
 	logger *log.Logger
 }
 
 func GetLogger(name string) *Logger {
 	logger := log.New(os.Stdout, "", log.Ldate|log.Ltime)
 	logger.SetOutput(color.Output)
+	level := int32(UNSPECIFIED)
 	return &Logger{
 		name:   name,
-		level:  UNSPECIFIED,
+		level:  &level,
 		logger: logger,
 	}
 }
 
+// SetOutput sets the output destination for the logger tree
+func (l *Logger) SetOutput(w io.Writer) {
+	l.logger.SetOutput(w)
+}
+
+// Flush writes any log lines queued by an AsyncWriter until the deadline,
+// and returns the number of lines left
+func (l *Logger) Flush(deadline time.Time) int {
+	if w, ok := l.logger.Writer().(*AsyncWriter); ok {
+		return w.Flush(deadline)
+	}
+	return 0
+}
+
 func (l *Logger) Child(name string) *Logger {
 	logger := *l
 	logger.name = fmt.Sprintf("%s.%s", l.name, name)
@@ -112,18 +159,64 @@ func (l *Logger) Child(name string) *Logger {
 }
 
 func (l *Logger) SetLogLevel(level Level) {
-	l.level = level
+	atomic.StoreInt32(l.level, int32(level))
+}
+
+// EffectiveLogLevel returns the log level shared by the logger tree
+func (l *Logger) EffectiveLogLevel() Level {
+	return Level(atomic.LoadInt32(l.level))
+}
+
+// CycleLogLevel switches between INFO, DEBUG and TRACE, and returns the new level
+func (l *Logger) CycleLogLevel() Level {
+	var level Level
+	switch l.EffectiveLogLevel() {
+	case DEBUG:
+		level = TRACE
+	case TRACE:
+		level = INFO
+	default:
+		level = DEBUG
+	}
+	l.SetLogLevel(level)
+	return level
+}
+
+// SetFormat selects "text" or "logfmt" lines; child loggers created
+// afterwards inherit the format
+func (l *Logger) SetFormat(format string) bool {
+	switch format {
+	case "text":
+		l.logfmt = false
+		l.logger.SetFlags(log.Ldate | log.Ltime)
+	case "logfmt":
+		l.logfmt = true
+		l.logger.SetFlags(0)
+	default:
+		return false
+	}
+	return true
+}
+
+// SetMaxLength limits the length of logged messages (0 means unlimited)
+func (l *Logger) SetMaxLength(maxLen int) {
+	l.maxLen = maxLen
 }
 
 func (l *Logger) printf(level Level, format string, args ...interface{}) {
-	if level > l.level {
+	current := l.EffectiveLogLevel()
+	if level > current {
+		return
+	}
+	if l.logfmt {
+		l.printLogfmt(level, current, format, args...)
 		return
 	}
 
 	ourFormat := ""
 	ourArgs := make([]interface{}, 0)
 
-	if l.level >= DEBUG { // Performance and readability optimization
+	if current >= DEBUG { // Performance and readability optimization
 		_, file, line, ok := runtime.Caller(2)
 		if ok {
 			ourFormat += "%s:%d "
@@ -134,8 +227,66 @@ func (l *Logger) printf(level Level, format string, args ...interface{}) {
 	ourFormat += "%s %s: "
 	ourArgs = append(ourArgs, l.name, level)
 
-	l.logger.Printf(ourFormat+format, append(ourArgs, args...)...)
-	// level.Color().Printf(ourFormat+format+"\n", append(ourArgs, args...)...)
+	message := fmt.Sprintf(format, args...)
+	if l.maxLen > 0 && len(message) > l.maxLen {
+		message = truncate(message, l.maxLen)
+	}
+
+	l.logger.Printf(ourFormat+"%s", append(ourArgs, message)...)
+	// level.Color().Printf(ourFormat+"%s\n", append(ourArgs, message)...)
+}
+
+// printLogfmt writes a "key=value" line, as printf does in the text format
+func (l *Logger) printLogfmt(level, current Level, format string, args ...interface{}) {
+	var b strings.Builder
+	b.WriteString("ts=")
+	b.WriteString(time.Now().UTC().Format(time.RFC3339Nano))
+	b.WriteString(" level=")
+	b.WriteString(level.Name())
+	b.WriteString(" logger=")
+	b.WriteString(logfmtValue(l.name))
+	if current >= DEBUG {
+		_, file, line, ok := runtime.Caller(3)
+		if ok {
+			b.WriteString(" caller=")
+			b.WriteString(logfmtValue(fmt.Sprintf("%s:%d", path.Base(file), line)))
+		}
+	}
+	message := fmt.Sprintf(format, args...)
+	if l.maxLen > 0 && len(message) > l.maxLen {
+		message = truncate(message, l.maxLen)
+	}
+	b.WriteString(" msg=")
+	b.WriteString(logfmtValue(message))
+	l.logger.Print(b.String())
+}
+
+// logfmtValue quotes and escapes a value unless it is a plain word
+func logfmtValue(value string) string {
+	if value == "" {
+		return `""`
+	}
+	for _, r := range value {
+		if r <= ' ' || r == '=' || r == '"' || r == '\\' || r >= utf8.RuneSelf {
+			return strconv.Quote(value)
+		}
+	}
+	return value
+}
+
+// truncate shortens message to at most maxLen bytes without splitting
+// a UTF-8 sequence, and appends the original length
+func truncate(message string, maxLen int) string {
+	cut := maxLen
+	for cut > 0 && !utf8.RuneStart(message[cut]) {
+		cut--
+	}
+	return fmt.Sprintf("%s... (%d bytes total)", message[:cut], len(message))
+}
+
+// Logf logs at the given level
+func (l *Logger) Logf(level Level, format string, args ...interface{}) {
+	l.printf(level, format, args...)
 }
 
 func (l *Logger) Errorf(format string, args ...interface{}) {
@@ -154,4 +305,78 @@ func (l *Logger) Debugf(format string, args ...interface{}) {
 	l.printf(DEBUG, format, args...)
 }
 
+func (l *Logger) Tracef(format string, args ...interface{}) {
+	l.printf(TRACE, format, args...)
+}
+
+// AsyncWriter queues log lines and writes them from a background goroutine,
+// so that logging does not block the caller unless the queue is full.
+// Queued lines that were not flushed are lost if the process crashes.
+type AsyncWriter struct {
+	w     io.Writer
+	lines chan []byte
+	flush chan chan struct{}
+}
+
+// NewAsyncWriter returns a new AsyncWriter with a queue of depth lines
+func NewAsyncWriter(w io.Writer, depth int) *AsyncWriter {
+	a := &AsyncWriter{
+		w:     w,
+		lines: make(chan []byte, depth),
+		flush: make(chan chan struct{}),
+	}
+	go a.run()
+	return a
+}
+
+// Write queues a copy of p, as log.Logger reuses its buffer
+func (a *AsyncWriter) Write(p []byte) (int, error) {
+	line := make([]byte, len(p))
+	copy(line, p)
+	a.lines <- line
+	return len(p), nil
+}
+
+// Flush waits until all the currently queued lines are written or the
+// deadline passes, and returns the number of lines left
+func (a *AsyncWriter) Flush(deadline time.Time) int {
+	done := make(chan struct{})
+	timer := time.NewTimer(time.Until(deadline))
+	defer timer.Stop()
+	select {
+	case a.flush <- done:
+	case <-timer.C:
+		return len(a.lines)
+	}
+	select {
+	case <-done:
+		return 0
+	case <-timer.C:
+		return len(a.lines)
+	}
+}
+
+func (a *AsyncWriter) run() {
+	for {
+		select {
+		case line := <-a.lines:
+			_, _ = a.w.Write(line)
+		case done := <-a.flush:
+			a.drain()
+			close(done)
+		}
+	}
+}
+
+func (a *AsyncWriter) drain() {
+	for {
+		select {
+		case line := <-a.lines:
+			_, _ = a.w.Write(line)
+		default:
+			return
+		}
+	}
+}
+
 // vim: noet:ts=4:sw=4:sts=4:spell
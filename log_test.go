@@ -0,0 +1,51 @@
+/*
+ *  b4ck-client
+ *  Copyright 2020 Michał Trojnara
+
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU General Public License as published by
+ *  the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU General Public License for more details.
+
+ *  You should have received a copy of the GNU General Public License
+ *  along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestChildInheritsLogLevel(t *testing.T) {
+	var buf bytes.Buffer
+	root := GetLogger("root")
+	root.logger.SetOutput(&buf)
+	root.SetLogLevel(INFO)
+	child := root.Child("child").Child("grandchild") // Before the change
+
+	child.Debugf("hidden")
+	root.SetLogLevel(DEBUG)
+	if level := child.EffectiveLogLevel(); level != DEBUG {
+		t.Errorf("Child level %s after setting DEBUG on the root", level)
+	}
+	child.Debugf("shown")
+	if out := buf.String(); strings.Contains(out, "hidden") || !strings.Contains(out, "shown") {
+		t.Errorf("Unexpected child output: %q", out)
+	}
+
+	// The level is shared by the whole tree
+	child.SetLogLevel(INFO)
+	if level := root.EffectiveLogLevel(); level != INFO {
+		t.Errorf("Root level %s after setting INFO on a child", level)
+	}
+}
+
+// vim: noet:ts=4:sw=4:sts=4:spell
@@ -23,34 +23,177 @@ import (
 	"encoding/base64"
 	"flag"
 	"fmt"
+	"io"
 	"math/rand"
 	"net"
 	"os"
+	"os/signal"
+	"strconv"
 	"strings"
+	"sync/atomic"
+	"syscall"
 	"time"
+
+	"github.com/fatih/color"
+)
+
+// version, commit and buildDate are set at build time with
+// -ldflags "-X main.version=... -X main.commit=... -X main.buildDate=..."
+var (
+	version   = "dev"
+	commit    = "unknown"
+	buildDate = "unknown"
+)
+
+var (
+	metricConnections = metrics.NewCounter("b4ck_connections_total", "Forwarded connections")
+	metricSent        = metrics.NewCounter("b4ck_bytes_sent_total", "Bytes sent by forwarded connections")
+	metricRcvd        = metrics.NewCounter("b4ck_bytes_received_total", "Bytes received by forwarded connections")
+	metricReady       = metrics.NewGauge("b4ck_ready_connections", "Control connections waiting for work")
+	metricRemote      = metrics.NewCounter("b4ck_remote_connections_total", "Established connections to the remote server")
+
+	metricTunnelConnections = metrics.NewCounterVec("b4ck_tunnel_connections_total",
+		"Forwarded connections by tunnel and backend", "tunnel", "backend")
+	metricTunnelSent = metrics.NewCounterVec("b4ck_tunnel_bytes_sent_total",
+		"Bytes sent by forwarded connections by tunnel and backend", "tunnel", "backend")
+	metricTunnelRcvd = metrics.NewCounterVec("b4ck_tunnel_bytes_received_total",
+		"Bytes received by forwarded connections by tunnel and backend", "tunnel", "backend")
+
+	// Connections classified by the server fast flag
+	metricClassConnections = metrics.NewCounterVec("b4ck_class_connections_total",
+		"Forwarded connections by fast or slow class", "class")
+	metricClassSent = metrics.NewCounterVec("b4ck_class_bytes_sent_total",
+		"Bytes sent by forwarded connections by class", "class")
+	metricClassRcvd = metrics.NewCounterVec("b4ck_class_bytes_received_total",
+		"Bytes received by forwarded connections by class", "class")
+	metricClassConnect = metrics.NewCounterVec("b4ck_class_connect_milliseconds_total",
+		"Time from the start message to the connected local service by class", "class")
+	metricClassDuration = metrics.NewCounterVec("b4ck_class_duration_milliseconds_total",
+		"Lifetime of forwarded connections by class", "class")
 )
 
 type Context struct {
+	connID    uint64 // Accessed atomically, keep 64-bit aligned
+	connIDMax uint64
+	rnet      string
 	raddr     string
 	laddr     string
 	port      int
+	tag       string
+	tunnel    string // Metric label
 	key       []byte
-	connID    chan uint64
+	auth      string
 	logger    *Logger
+	connLevel Level // Of the remote connection messages, if set
 	tlsConfig *tls.Config
+	serverLog map[string]bool
+	blocklist *Blocklist
+
+	sourceLimit *SourceLimit
+
+	unknownRecycle  bool
+	infoContinue    bool
+	syncFraming     bool
+	tolerantFraming bool
+
+	resumeTracker *ResumeTracker
+	certExpiry    *CertExpiry
+	tlsDebug      bool
+	tlsLogCipher  bool
+	handshakes    chan struct{} // Semaphore of in-flight handshakes
+	tlsFallback   bool
+
+	quota     *Quota // Nil if unlimited
+	quotaExit bool
+
+	localPorts  *PortRange
+	targetPorts PortList // Local ports the server may select
+	backend     *Backend
+
+	localTLS           *tls.Config
+	localTLSReport     bool
+	localTLSName       string
+	localTLSNames      map[string]string // Keyed by the client TLS SNI
+	localTLSForwardSNI bool
+
+	routes       *Routes
+	routeTimeout time.Duration
+
+	closeOrder      CloseOrder
+	closeWriteReset bool
+	closeTimeout    time.Duration
+	firstByte       time.Duration
+	coalesce        time.Duration
+	readSizes       bool
+	dialer          net.Dialer
+	relays          []*Relay
+	faults          *Faults // Testing only
+
+	localDials        chan struct{} // Semaphore of concurrent local dials
+	localDialWait     time.Duration
+	localDialAttempts int
+	localDialDelay    time.Duration
+	localDialJitter   time.Duration
+
+	pool            *Pool
+	readiness       Readiness
+	prewarmLimit    *StartupLimiter
+	poolMax         int
+	serverPoolSize  bool
+	poolGoroutine   bool
+	failFast        bool
+	simplePool      bool
+	fastIdle        time.Duration
+	slowMaxLifetime time.Duration
+	maxKeepalives   int
+	timeoutToken    string
+
+	listenDeadline    time.Duration // Zero keeps the connection deadline
+	keepaliveDeadline time.Duration
+
+	debugKeepaliveSkip  float64
+	debugKeepaliveDelay time.Duration
+	debugSuccessDelay   time.Duration
+	debugSuccessJitter  time.Duration
+
+	onConnect *Hook
+	onClose   *Hook
+	onBackoff *Hook
+	onReady   *Hook
+	hooks     *HookQueue
+
+	flushTimeout time.Duration
+	exitSummary  bool
+	started      time.Time
+	rand         *rand.Rand // Seeded with randomSeed, safe for concurrent use
+
+	records *RecordLog
+	active  *ConnRegistry // Set with the admin server
+
+	liveBytes bool // Count the bytes of active connections while copying
 }
 
+// Exit codes, distinct for each category of fatal errors
+const (
+	ExitOK      = 0
+	ExitFailure = 1 // Self-test failures and unexpected errors
+	ExitConfig  = 2 // Invalid settings, as for invalid flags
+	ExitServer  = 3 // Error messages from the server, e.g. a rejected key
+	ExitNetwork = 4 // Failed address resolution, listening, or -require-backend
+	ExitQuota   = 5 // Transfer quota exceeded with -quota-exit
+)
+
 func main() {
 	// Initialize configuration
 	c := GetContext()
+	c.handleSignals()
 
 	// Spawn a pool of workers
-	rand.Seed(time.Now().UnixNano())
-	for i := 2; i > 0; i-- {
-		go c.worker(c.logger.Child(fmt.Sprintf("%d", i)))
-		time.Sleep(time.Duration(900+rand.Int31n(200)) * time.Millisecond)
+	if c.poolGoroutine {
+		go c.pool.Run()
+		c.shutdown() // Block until SIGINT or SIGTERM
 	}
-	c.worker(c.logger.Child("0"))
+	c.pool.Run()
 }
 
 func GetContext() *Context {
@@ -59,7 +202,214 @@ func GetContext() *Context {
 	confKey := flag.String("k", "", "authentication key (mandatory)")
 	confDebug := flag.String("d", "INFO", "log verbosity")
 	confNoTLS := flag.Bool("t", false, "disable TLS (debugging only)")
+	confAuth := flag.String("auth", AuthRaw, "authentication scheme: raw or hmac-sha256")
+	confSyncFraming := flag.Bool("sync-framing", false,
+		"request self-synchronizing frames from the server")
+	confProxy := flag.String("proxy", "",
+		"comma-separated chain of socks5:// or http:// proxies to reach the server through")
+	confTolerantFraming := flag.Bool("tolerant-framing", false,
+		"accept server messages sent without the length prefix")
+	confRnet := flag.String("remote-net", "tcp",
+		"remote network (tcp, tcp4 or tcp6)")
+	confConnIDMax := flag.Uint64("connid-max", 0,
+		"wrap connection ids in logs to 0 at this value (0 disables)")
+	confLogMaxLen := flag.Int("log-max-len", 1024,
+		"maximum length of a logged message (0 means unlimited)")
+	confLogFormat := flag.String("logformat", "text", "log line format: text or logfmt")
+	confConnLogLevel := flag.String("conn-log-level", "",
+		"log level of all new remote connection messages (by default INFO for new TLS sessions, DEBUG otherwise)")
+	confLogFile := flag.String("log-file", "", "append logs to this file instead of the standard output")
+	confServerLog := flag.String("server-log", "debug,info,warning,error",
+		"comma-separated server message types to log")
+	confInfoContinue := flag.Bool("info-continue", false,
+		"keep the connection after debug, info and warning server messages")
+	confUnknownMsg := flag.String("unknown-msg", "ignore",
+		"action on server messages of unknown type: ignore or recycle")
+	confBlocklist := flag.String("blocklist", "",
+		"file with blocked source addresses (reloaded on SIGHUP)")
+	confMaxPerIP := flag.Int("max-per-ip", 0,
+		"maximum concurrent connections from a single source IP address (0 disables)")
+	confTLSDebug := flag.Bool("tls-debug", false,
+		"log the TLS connection details at DEBUG")
+	confTLSLogCipher := flag.Bool("tls-log-cipher", false,
+		"log the cipher suite and key exchange group of new connections")
+	confMaxLocalDials := flag.Int("max-local-dials", 0,
+		"maximum number of concurrent local service dials (0 is unlimited)")
+	confLocalDialWait := flag.Duration("local-dial-wait", 5*time.Second,
+		"time to wait for a free local dial slot with -max-local-dials")
+	confLocalDialAttempts := flag.Int("local-dial-attempts", 1,
+		"number of attempts to connect the local service")
+	confLocalDialDelay := flag.Duration("local-dial-retry-delay", 100*time.Millisecond,
+		"delay between local dial attempts")
+	confLocalDialJitter := flag.Duration("local-dial-retry-jitter", 100*time.Millisecond,
+		"maximum random delay added to -local-dial-retry-delay")
+	confMaxHandshakes := flag.Int("max-handshakes", 0,
+		"maximum number of concurrent TLS handshakes (0 is unlimited)")
+	confTLSFallback := flag.Bool("tls-fallback", false,
+		"retry without TLS if the server does not support it (insecure)")
+	confALPNVersion := flag.Bool("alpn-version", false,
+		"advertise the client version as a TLS ALPN protocol")
+	confSessionCache := flag.String("session-cache", "",
+		"file to save TLS sessions for resumption after a restart")
+	confResumeAlarm := flag.Float64("resume-alarm", 0,
+		"warn below this TLS session resumption rate (0 disables)")
+	confResumeWindow := flag.Int("resume-window", 100,
+		"number of TLS handshakes for the resumption rate")
+	confCertExpiry := flag.Int("cert-expiry-warn", 0,
+		"report the server certificate expiry, and warn below this many days (0 disables)")
+	confQuota := flag.Uint64("quota", 0,
+		"refuse new connections and close the open ones after forwarding this many bytes, counted while copying, which disables zero-copy forwarding (0 means unlimited)")
+	confQuotaExit := flag.Bool("quota-exit", false,
+		"exit instead of refusing connections when the quota is exceeded")
+	confTags := flag.String("tags", "",
+		"service tags by local port sent to the server, e.g. 80=web,22=ssh")
+	confTunnelName := flag.String("tunnel-name", "",
+		"tunnel label of the per-tunnel metrics (the service tag or the local address by default)")
+	confLocalPorts := flag.String("local-ports", "",
+		"source port range for local connections, e.g. 40000-40999")
+	confTargetPorts := flag.String("target-ports", "",
+		"comma-separated local ports and ranges the server may select in START messages (disabled by default)")
+	confWorkers := flag.Int("workers", 3, "number of slow connection workers")
+	confPoolGoroutine := flag.Bool("pool-goroutine", false,
+		"run all workers on goroutines, with the main goroutine waiting for SIGINT or SIGTERM")
+	confFailFast := flag.Bool("fail-fast", false,
+		"exit on a panic instead of recovering the connection or worker")
+	confSimplePool := flag.Bool("simple-pool", false,
+		"ignore the fast connection flag and use only the worker pool")
+	confServerPoolSize := flag.Bool("server-pool-size", false,
+		"apply the number of slow connection workers hinted by the server")
+	confPoolMax := flag.Int("pool-max", 0,
+		"maximum number of workers the server may request (-workers by default)")
+	confPrewarmCap := flag.Int("prewarm-startup-cap", 0,
+		"fast connections prewarmed at startup before any worker is connected, plus one per connected worker; others wait until the pool is connected or -prewarm-startup-window elapses (0 disables)")
+	confPrewarmWindow := flag.Duration("prewarm-startup-window", 10*time.Second,
+		"startup period limited by -prewarm-startup-cap")
+	confMinWorkers := flag.Int("min-workers", 0,
+		"scale idle workers down to this number (default: no scaling)")
+	confFillWindow := flag.Duration("fill-report", 0,
+		"log how fast the worker pool connects within this time after startup (0 disables)")
+	confWorkerIdle := flag.Duration("worker-idle", 10*time.Minute,
+		"time without served connections before a worker is idle")
+	confWorkerNames := flag.String("worker-names", "number",
+		"worker names in logs: number, padded (zero-padded) or random (number with a random tag)")
+	confShuffleWorkers := flag.Bool("shuffle-workers", false,
+		"start workers in random order")
+	confFastIdle := flag.Duration("fast-idle", 0,
+		"recycle fast connections waiting longer for work (0 disables)")
+	confSlowMaxLifetime := flag.Duration("slow-max-lifetime", 0,
+		"recycle slow connections at the first keepalive after this time (0 disables)")
+	confListenDeadline := flag.Duration("listen-deadline", 0,
+		"time to wait for the first server message after LISTEN (default: the connection deadline of 1m)")
+	confKeepaliveDeadline := flag.Duration("keepalive-deadline", time.Minute,
+		"time to wait for the next server message after a KEEPALIVE response")
+	confMaxKeepalives := flag.Int("max-keepalives", 0,
+		"recycle slow connections after this many keepalives (0 disables)")
+	confTimeoutToken := flag.String("timeout-token", "TIMEOUT",
+		"info text sent when recycling a fast connection on keepalive (empty sends nothing)")
+	confDebugKeepaliveSkip := flag.Float64("debug-keepalive-skip", 0,
+		"debugging: probability (0-1) of not responding to a slow connection keepalive")
+	confDebugKeepaliveDelay := flag.Duration("debug-keepalive-delay", 0,
+		"debugging: delay of slow connection keepalive responses")
+	confDebugSuccessDelay := flag.Duration("debug-success-delay", 0,
+		"debugging: delay of SUCCESS after connecting the local service")
+	confDebugSuccessJitter := flag.Duration("debug-success-jitter", 0,
+		"debugging: maximum random delay added to -debug-success-delay")
+	confLocalTLS := flag.Bool("local-tls", false, "connect the local service with TLS")
+	confLocalTLSInsecure := flag.Bool("local-tls-insecure", false,
+		"do not verify the local service certificate")
+	confLocalTLSReport := flag.Bool("local-tls-report", false,
+		"report the local TLS version, protocol and certificate subject to the server")
+	confRoute := flag.String("route", "",
+		"comma-separated protocol=address backends selected by the first client bytes (http, tls, ssh or sni:name)")
+	confRouteTimeout := flag.Duration("route-timeout", 3*time.Second,
+		"time to wait for the first client bytes with -route")
+	confLocalTLSName := flag.String("local-tls-servername", "",
+		"default local TLS server name (the host of the local address by default)")
+	confLocalTLSSNIMap := flag.String("local-tls-sni-map", "",
+		"comma-separated client=backend TLS server names for clients detected with -route")
+	confLocalTLSForwardSNI := flag.Bool("local-tls-forward-sni", false,
+		"use the TLS SNI of clients detected with -route as the local TLS server name")
+	confCheckBackend := flag.Bool("check-backend", false,
+		"make a test connection to the local service at startup")
+	confRequireBackend := flag.Bool("require-backend", false,
+		"exit if the startup test connection to the local service fails")
+	confDSCP := flag.Int("dscp", 0, "DSCP value (0-63) to mark remote and local connections with")
+	confResolver := flag.String("resolver", "",
+		"DNS server for remote and local addresses, e.g. 1.1.1.1:53 or tls://1.1.1.1 (the system resolver by default)")
+	confTCPUserTimeout := flag.Duration("tcp-user-timeout", 0,
+		"time unacknowledged data may be retransmitted before a remote or local connection fails (Linux only, 0 disables)")
+	confCoalesce := flag.Duration("coalesce", 0,
+		"maximum delay for batching control messages into one write (0 disables)")
+	confCloseOrder := flag.String("close-order", "symmetric",
+		"direction to wait for before closing the other: symmetric, local-first or remote-first")
+	confCloseWriteReset := flag.Bool("closewrite-reset", false,
+		"reset both connections if half-closing one of them fails")
+	confCloseTimeout := flag.Duration("close-timeout", 0,
+		"time to close a proxied connection, e.g. sending a TLS close_notify, before resetting it (0 disables)")
+	confFirstByte := flag.Duration("first-byte-timeout", 0,
+		"close forwarded connections not receiving their first byte in either direction within this time (0 disables)")
+	confReadSizes := flag.Bool("read-sizes", false,
+		"log and export the distribution of forwarded read sizes")
+	confOnConnect := flag.String("on-connect", "",
+		"program to run when a connection starts")
+	confOnClose := flag.String("on-close", "",
+		"program to run when a connection is closed")
+	confOnBackoff := flag.String("on-backoff", "",
+		"program to run when a worker backs off after a failure")
+	confOnReady := flag.String("on-ready", "",
+		"program to run once the worker pool is connected")
+	confReadyQuorum := flag.Int("ready-quorum", 1,
+		"number of connected workers that make the pool ready")
+	confReadyOn := flag.String("ready-on", "control",
+		"readiness for -on-ready and /healthz: control, backend or both")
+	confRecords := flag.String("records", "",
+		"append a JSON line for each completed connection to this file")
+	confRecordsMaxSize := flag.Int64("records-max-size", 10<<20,
+		"rotate the connection records file at this size in bytes (0 disables)")
+	confRecordsKeep := flag.Int("records-keep", 5,
+		"number of rotated connection records files to keep")
+	confHookRate := flag.Int("hook-rate", 10,
+		"maximum number of hook programs started per second")
+	confHookQueue := flag.Int("hook-queue", 64,
+		"maximum number of queued hook events (excess events are dropped)")
+	confHookWorkers := flag.Int("hook-workers", 4,
+		"maximum number of concurrently running hook programs")
+	confFlushTimeout := flag.Duration("flush-timeout", 5*time.Second,
+		"time to wait at exit for pending hook events, connection records and logs")
+	confAdmin := flag.String("admin", "",
+		"admin server address for /status, /metrics, /healthz, /connections.json and /buildinfo (disabled by default)")
+	confLiveBytes := flag.Bool("live-bytes", false,
+		"report the bytes and idle times of active connections in /connections.json, omitted without it, by counting while copying (disables zero-copy forwarding)")
+	confRuntimeMetrics := flag.Bool("runtime-metrics", false,
+		"export goroutine, memory and file descriptor metrics")
+	confStdinConfig := flag.Bool("stdin-config", false,
+		"read settings, e.g. the key, from the standard input as JSON or NAME=value lines")
+	confStrictConfig := flag.Bool("strict-config", false,
+		"exit if a setting has different values on the command line and in the environment")
+	confRaiseNofile := flag.Bool("raise-nofile", false,
+		"raise the soft limit of open files to the hard limit at startup, as builds with Go 1.19 or later already do")
+	confLeakCheck := flag.Duration("leak-check", 0,
+		"interval of goroutine count checks for leaks (0 disables)")
+	confLeakThreshold := flag.Int("leak-threshold", 1000,
+		"goroutines above the lowest count that indicate a leak")
+	confVersion := flag.Bool("version", false,
+		"print the version and build information and exit")
+	confSelfTest := flag.Bool("selftest", false,
+		"verify the message serialization and exit")
+	confPrintAddrs := flag.Bool("print-addrs", false,
+		"print the remote, proxy, local and listen port addresses, resolved with -resolver, and exit")
+	confAsyncLog := flag.Bool("async-log", false,
+		"write logs asynchronously (recent lines may be lost on a crash)")
+	confExitSummary := flag.Bool("exit-summary", false,
+		"log the totals of the process lifetime on exit")
 	flag.Parse()
+	var stdinConflicts []string
+	var stdinErr error
+	if *confStdinConfig {
+		stdinConflicts, stdinErr = applyStdin(os.Stdin)
+	}
+	conflicts, envErr := applyEnv()
+	conflicts = append(stdinConflicts, conflicts...)
 
 	// Initialize logging
 	logger := GetLogger("b4ck")
@@ -69,18 +419,109 @@ func GetContext() *Context {
 		logger.SetLogLevel(DEBUG)
 	}
 	// logger.Infof("%s", logger.EffectiveLogLevel().String())
+	logger.SetMaxLength(*confLogMaxLen)
+	if !logger.SetFormat(*confLogFormat) {
+		logger.Errorf("Invalid log format: %s", *confLogFormat)
+		os.Exit(ExitConfig)
+	}
+	var logSink io.Writer = color.Output
+	if *confLogFile != "" {
+		file, err := os.OpenFile(*confLogFile, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0640)
+		if err != nil {
+			logger.Warningf("Failed to open log file, logging to the standard output: %s", err)
+		} else {
+			color.NoColor = true // No terminal escape sequences in the file
+			logSink = file
+			logger.SetOutput(logSink)
+		}
+	}
+	if stdinErr != nil {
+		logger.Errorf("Invalid configuration on the standard input: %s", stdinErr)
+		os.Exit(ExitConfig)
+	}
+	if envErr != nil {
+		logger.Errorf("Invalid environment variable %s", envErr)
+		os.Exit(ExitConfig)
+	}
+	for _, conflict := range conflicts {
+		if *confStrictConfig {
+			logger.Errorf("Conflicting settings: %s", conflict)
+		} else {
+			logger.Warningf("Conflicting settings: %s", conflict)
+		}
+	}
+	if len(conflicts) > 0 && *confStrictConfig {
+		os.Exit(ExitConfig)
+	}
+	for _, name := range sortedKeys(configSources) {
+		logger.Debugf("Setting -%s from the %s", name, configSources[name])
+	}
+
+	// Print the version instead of running the client
+	if *confVersion {
+		fmt.Println(getBuildInfo(time.Now()))
+		os.Exit(ExitOK)
+	}
 
-	// Check for mandatory flags
+	// Run the self-test instead of the client
+	if *confSelfTest {
+		if selfTest(logger) {
+			os.Exit(ExitOK)
+		}
+		os.Exit(ExitFailure)
+	}
+
+	// Check the resolved configuration for mandatory settings
 	mandatory := []string{"r", "k"}
-	seen := make(map[string]bool)
-	flag.Visit(func(f *flag.Flag) { seen[f.Name] = true })
-	for _, req := range mandatory {
-		if !seen[req] {
-			logger.Errorf("Missing mandatory -%s parameter", req)
-			os.Exit(2) // exit code used by flag.Parse
+	if *confPrintAddrs {
+		mandatory = mandatory[:1]
+	}
+	missing := missingSettings(mandatory...)
+	if len(missing) > 0 {
+		logger.Errorf("Missing mandatory settings: %s", strings.Join(missing, ", "))
+		os.Exit(ExitConfig)
+	}
+
+	// Validate the remote network
+	switch *confRnet {
+	case "tcp", "tcp4", "tcp6":
+	default:
+		logger.Errorf("Invalid remote network: %s", *confRnet)
+		os.Exit(ExitConfig)
+	}
+
+	// Parse the server message types to log
+	serverLog := make(map[string]bool)
+	for _, t := range strings.Split(*confServerLog, ",") {
+		switch t {
+		case "debug", "info", "warning", "error":
+			serverLog[t] = true
+		case "":
+		default:
+			logger.Errorf("Invalid server message type: %s", t)
+			os.Exit(ExitConfig)
+		}
+	}
+
+	// Parse the remote connection log level
+	connLevel := Level(UNSPECIFIED)
+	if *confConnLogLevel != "" {
+		var ok bool
+		connLevel, ok = ParseLevel(*confConnLogLevel)
+		if !ok {
+			logger.Errorf("Invalid connection log level: %s", *confConnLogLevel)
+			os.Exit(ExitConfig)
 		}
 	}
 
+	// Validate the unknown message action
+	switch *confUnknownMsg {
+	case "ignore", "recycle":
+	default:
+		logger.Errorf("Invalid unknown message action: %s", *confUnknownMsg)
+		os.Exit(ExitConfig)
+	}
+
 	// Split *confRaddr into raddr and port
 	t := strings.Split(*confRaddr, ":")
 	raddr := strings.Join(t[:len(t)-1], ":") + ":1"
@@ -88,61 +529,502 @@ func GetContext() *Context {
 	port, err := net.LookupPort("tcp", t[len(t)-1])
 	if err != nil {
 		logger.Errorf("Port lookup failed: %s", err)
-		os.Exit(1)
+		os.Exit(ExitConfig)
+	}
+
+	// Parse the proxy chain
+	var relays []*Relay
+	if *confProxy != "" {
+		relays, err = ParseRelayChain(*confProxy)
+		if err != nil {
+			logger.Errorf("Invalid proxy chain: %s", err)
+			os.Exit(ExitConfig)
+		}
+	}
+
+	// Print the resolved addresses instead of running the client
+	if *confPrintAddrs {
+		var resolver *net.Resolver
+		if *confResolver != "" {
+			resolver, err = newResolver(logger, *confResolver)
+			if err != nil {
+				logger.Errorf("Invalid resolver: %s", err)
+				os.Exit(ExitConfig)
+			}
+		}
+		err = printAddrs(os.Stdout, resolver, relays, *confRnet, raddr, port, *confLaddr)
+		if err != nil {
+			logger.Errorf("Address resolution failed: %s", err)
+			os.Exit(ExitNetwork)
+		}
+		os.Exit(ExitOK)
 	}
 
 	// Decode the authentication key
 	key, err := base64.RawStdEncoding.DecodeString(*confKey)
 	if err != nil {
 		logger.Errorf("Invalid key: %s", err)
-		os.Exit(1)
+		os.Exit(ExitConfig)
 	}
 	if len(key) != 6 {
 		logger.Errorf("Invalid decoded key length: %d", len(key))
-		os.Exit(1)
+		os.Exit(ExitConfig)
+	}
+
+	// Validate the authentication scheme
+	switch *confAuth {
+	case AuthRaw, AuthHMAC:
+	default:
+		logger.Errorf("Invalid authentication scheme: %s", *confAuth)
+		os.Exit(ExitConfig)
 	}
 
 	c := &Context{
-		raddr:  raddr,
-		laddr:  *confLaddr,
-		port:   port,
-		key:    key,
-		logger: logger,
-		connID: make(chan uint64),
-	}
-	go func() {
-		var id uint64
-		for {
-			c.connID <- id
-			id++
-		}
-	}()
+		rnet:      *confRnet,
+		raddr:     raddr,
+		laddr:     *confLaddr,
+		port:      port,
+		key:       key,
+		auth:      *confAuth,
+		logger:    logger,
+		connLevel: connLevel,
+		serverLog: serverLog,
+		backend:   NewBackend(*confLaddr),
+		relays:    relays,
+		connIDMax: *confConnIDMax,
+		started:   time.Now(),
+		rand:      newRand(randomSeed(logger)),
+
+		syncFraming:     *confSyncFraming,
+		tolerantFraming: *confTolerantFraming,
+		unknownRecycle:  *confUnknownMsg == "recycle",
+		infoContinue:    *confInfoContinue,
+	}
 
 	// Setup TLS configuration
 	if !*confNoTLS {
 		c.tlsConfig = &tls.Config{
 			ServerName:         "free.b4ck.net",
 			MinVersion:         tls.VersionTLS13,
-			ClientSessionCache: tls.NewLRUClientSessionCache(32),
+			ClientSessionCache: newSessionCache(logger, *confSessionCache, 32),
+		}
+		if *confALPNVersion {
+			c.tlsConfig.NextProtos = []string{"b4ck-client/" + version}
+		}
+		c.tlsDebug = *confTLSDebug
+		c.tlsLogCipher = *confTLSLogCipher
+		if *confMaxHandshakes > 0 {
+			c.handshakes = make(chan struct{}, *confMaxHandshakes)
+		}
+		c.tlsFallback = *confTLSFallback
+		if *confResumeAlarm > 0 {
+			if *confResumeWindow < 1 {
+				logger.Errorf("Invalid resumption window: %d", *confResumeWindow)
+				os.Exit(ExitConfig)
+			}
+			c.resumeTracker = NewResumeTracker(*confResumeAlarm, *confResumeWindow)
+		}
+		if *confCertExpiry > 0 {
+			c.certExpiry = NewCertExpiry(*confCertExpiry)
+		}
+	}
+
+	// Load the source address blocklist
+	if *confBlocklist != "" {
+		c.blocklist, err = LoadBlocklist(*confBlocklist)
+		if err != nil {
+			logger.Errorf("Failed to load blocklist: %s", err)
+			os.Exit(ExitConfig)
+		}
+		logger.Infof("Loaded %d blocklist entries", c.blocklist.Len())
+	}
+
+	// Limit the concurrent connections per source
+	if *confMaxPerIP < 0 {
+		logger.Errorf("Invalid connection limit per source: %d", *confMaxPerIP)
+		os.Exit(ExitConfig)
+	}
+	if *confMaxPerIP > 0 {
+		c.sourceLimit = NewSourceLimit(*confMaxPerIP)
+	}
+
+	// Configure the transfer quota
+	if *confQuota > 0 {
+		c.quota = NewQuota(*confQuota)
+	}
+	c.quotaExit = *confQuotaExit
+
+	// Map the local port to a service tag
+	if *confTags != "" {
+		c.tag, err = serviceTag(*confTags, c.laddr)
+		if err != nil {
+			logger.Errorf("Invalid service tags: %s", err)
+			os.Exit(ExitConfig)
+		}
+		if c.tag != "" {
+			logger.Infof("Service tag: %s", c.tag)
+		}
+	}
+
+	// Name the tunnel in metric labels
+	switch {
+	case *confTunnelName != "":
+		c.tunnel = *confTunnelName
+	case c.tag != "":
+		c.tunnel = c.tag
+	default:
+		c.tunnel = c.laddr
+	}
+
+	// Parse the local source port range
+	if *confLocalPorts != "" {
+		c.localPorts, err = ParsePortRange(*confLocalPorts)
+		if err != nil {
+			logger.Errorf("Invalid local source ports: %s", *confLocalPorts)
+			os.Exit(ExitConfig)
+		}
+	}
+
+	// Parse the local ports selectable by the server
+	if *confTargetPorts != "" {
+		c.targetPorts, err = ParsePortList(*confTargetPorts)
+		if err != nil {
+			logger.Errorf("Invalid target ports: %s", err)
+			os.Exit(ExitConfig)
+		}
+	}
+
+	// Setup local TLS configuration
+	if *confLocalTLS {
+		_, _, err := net.SplitHostPort(c.laddr)
+		if err != nil {
+			logger.Errorf("Invalid local address: %s", err)
+			os.Exit(ExitConfig)
+		}
+		c.localTLSName = *confLocalTLSName
+		c.localTLSForwardSNI = *confLocalTLSForwardSNI
+		if *confLocalTLSSNIMap != "" {
+			c.localTLSNames, err = ParseServerNames(*confLocalTLSSNIMap)
+			if err != nil {
+				logger.Errorf("Invalid local TLS server names: %s", err)
+				os.Exit(ExitConfig)
+			}
+		}
+		c.localTLS = &tls.Config{
+			ServerName:         c.serverNameFor(c.laddr, ""),
+			InsecureSkipVerify: *confLocalTLSInsecure,
+		}
+		c.localTLSReport = *confLocalTLSReport
+	}
+	if (c.localTLSNames != nil || c.localTLSForwardSNI) && *confRoute == "" {
+		logger.Warningf("The client TLS SNI is only detected with -route")
+	}
+
+	// Parse the protocol routes
+	if *confRoute != "" {
+		if c.localTLSReport {
+			logger.Errorf("The local TLS report cannot be sent with -route")
+			os.Exit(ExitConfig)
+		}
+		c.routes, err = ParseRoutes(*confRoute)
+		if err != nil {
+			logger.Errorf("Invalid routes: %s", err)
+			os.Exit(ExitConfig)
+		}
+		c.routeTimeout = *confRouteTimeout
+	}
+
+	// Configure the DSCP marking
+	if *confDSCP < 0 || *confDSCP > 63 {
+		logger.Errorf("Invalid DSCP value: %d", *confDSCP)
+		os.Exit(ExitConfig)
+	}
+	if *confDSCP != 0 {
+		control, err := dscpControl(logger, *confDSCP)
+		if err != nil {
+			logger.Warningf("DSCP marking disabled: %s", err)
+		}
+		c.dialer.Control = chainControl(c.dialer.Control, control)
+	}
+
+	// Configure the DNS resolver
+	if *confResolver != "" {
+		c.dialer.Resolver, err = newResolver(logger, *confResolver)
+		if err != nil {
+			logger.Errorf("Invalid resolver: %s", err)
+			os.Exit(ExitConfig)
+		}
+	}
+
+	// Enable fault injection for testing
+	if s := os.Getenv("B4CK_FAULTS"); s != "" {
+		c.faults, err = ParseFaults(s, c.rand)
+		if err != nil {
+			logger.Errorf("Invalid B4CK_FAULTS: %s", err)
+			os.Exit(ExitConfig)
+		}
+		logger.Warningf("Fault injection enabled: %s", s)
+	}
+
+	// Configure the TCP user timeout
+	if *confTCPUserTimeout > 0 {
+		control, err := userTimeoutControl(logger, *confTCPUserTimeout)
+		if err != nil {
+			logger.Warningf("TCP user timeout disabled: %s", err)
+		}
+		c.dialer.Control = chainControl(c.dialer.Control, control)
+	}
+
+	// Parse the close order
+	c.closeOrder, err = ParseCloseOrder(*confCloseOrder)
+	if err != nil {
+		logger.Errorf("Invalid close order: %s", err)
+		os.Exit(ExitConfig)
+	}
+	c.closeWriteReset = *confCloseWriteReset
+	if *confMaxLocalDials > 0 {
+		c.localDials = make(chan struct{}, *confMaxLocalDials)
+	}
+	c.localDialWait = *confLocalDialWait
+	if *confLocalDialAttempts < 1 || *confLocalDialDelay < 0 || *confLocalDialJitter < 0 {
+		logger.Errorf("Invalid local dial retry: %d attempts, %s delay, %s jitter",
+			*confLocalDialAttempts, *confLocalDialDelay, *confLocalDialJitter)
+		os.Exit(ExitConfig)
+	}
+	c.localDialAttempts = *confLocalDialAttempts
+	c.localDialDelay = *confLocalDialDelay
+	c.localDialJitter = *confLocalDialJitter
+	c.closeTimeout = *confCloseTimeout
+	c.firstByte = *confFirstByte
+	c.readSizes = *confReadSizes
+
+	// Configure the worker pool
+	minWorkers := *confMinWorkers
+	if minWorkers == 0 {
+		minWorkers = *confWorkers
+	}
+	if *confWorkers < 1 || minWorkers < 1 || minWorkers > *confWorkers {
+		logger.Errorf("Invalid number of workers: %d-%d", minWorkers, *confWorkers)
+		os.Exit(ExitConfig)
+	}
+	c.pool = NewPool(c, *confWorkers, minWorkers, *confWorkerIdle)
+	c.pool.fillWindow = *confFillWindow
+	c.pool.naming, err = ParseWorkerNaming(*confWorkerNames)
+	if err != nil {
+		logger.Errorf("Invalid worker names: %s", err)
+		os.Exit(ExitConfig)
+	}
+	c.pool.shuffle = *confShuffleWorkers
+	if *confReadyQuorum < 1 {
+		logger.Errorf("Invalid ready quorum: %d", *confReadyQuorum)
+		os.Exit(ExitConfig)
+	}
+	c.pool.quorum = *confReadyQuorum
+	c.readiness, err = ParseReadiness(*confReadyOn)
+	if err != nil {
+		logger.Errorf("Invalid readiness: %s", err)
+		os.Exit(ExitConfig)
+	}
+	c.simplePool = *confSimplePool
+	if *confPrewarmCap > 0 {
+		c.prewarmLimit = NewStartupLimiter(*confPrewarmCap, *confPrewarmWindow)
+	}
+	c.serverPoolSize = *confServerPoolSize
+	c.poolMax = *confPoolMax
+	if c.poolMax == 0 {
+		c.poolMax = *confWorkers
+	}
+	if c.poolMax < minWorkers {
+		logger.Errorf("Invalid maximum number of workers: %d", c.poolMax)
+		os.Exit(ExitConfig)
+	}
+	c.poolGoroutine = *confPoolGoroutine
+	c.failFast = *confFailFast
+	c.fastIdle = *confFastIdle
+	c.slowMaxLifetime = *confSlowMaxLifetime
+	c.maxKeepalives = *confMaxKeepalives
+	if *confListenDeadline < 0 || *confKeepaliveDeadline <= 0 {
+		logger.Errorf("Invalid deadlines: %s after LISTEN, %s after KEEPALIVE",
+			*confListenDeadline, *confKeepaliveDeadline)
+		os.Exit(ExitConfig)
+	}
+	c.listenDeadline = *confListenDeadline
+	c.keepaliveDeadline = *confKeepaliveDeadline
+	c.timeoutToken = *confTimeoutToken
+	if !(*confDebugKeepaliveSkip >= 0 && *confDebugKeepaliveSkip <= 1) { // Also rejects NaN
+		logger.Errorf("Invalid keepalive skip probability: %g", *confDebugKeepaliveSkip)
+		os.Exit(ExitConfig)
+	}
+	c.debugKeepaliveSkip = *confDebugKeepaliveSkip
+	c.debugKeepaliveDelay = *confDebugKeepaliveDelay
+	c.debugSuccessDelay = *confDebugSuccessDelay
+	c.debugSuccessJitter = *confDebugSuccessJitter
+	c.coalesce = *confCoalesce
+
+	// Open the connection records file
+	if *confRecords != "" {
+		c.records, err = NewRecordLog(logger, *confRecords, *confRecordsMaxSize, *confRecordsKeep, 1024)
+		if err != nil {
+			logger.Warningf("Connection records disabled: %s", err)
+		}
+	}
+
+	// Configure the connection hooks
+	if *confHookRate < 1 || *confHookQueue < 0 || *confHookWorkers < 1 {
+		logger.Errorf("Invalid hook rate, queue or workers")
+		os.Exit(ExitConfig)
+	}
+	if *confOnConnect != "" || *confOnClose != "" || *confOnBackoff != "" || *confOnReady != "" {
+		queue := NewHookQueue(logger, *confHookQueue, *confHookWorkers)
+		c.hooks = queue
+		if *confOnConnect != "" {
+			c.onConnect = NewHook(*confOnConnect, *confHookRate, queue)
+		}
+		if *confOnClose != "" {
+			c.onClose = NewHook(*confOnClose, *confHookRate, queue)
+		}
+		if *confOnBackoff != "" {
+			c.onBackoff = NewHook(*confOnBackoff, *confHookRate, queue)
+		}
+		if *confOnReady != "" {
+			c.onReady = NewHook(*confOnReady, *confHookRate, queue)
+		}
+	}
+
+	c.flushTimeout = *confFlushTimeout
+
+	// Export the runtime metrics
+	if *confRuntimeMetrics {
+		registerRuntimeMetrics()
+	}
+
+	// Raise the open file limit before any connections are made
+	if *confRaiseNofile {
+		raiseFileLimit(logger)
+	}
+
+	// Monitor the goroutine count
+	if *confLeakCheck > 0 {
+		go monitorGoroutines(logger, *confLeakCheck, *confLeakThreshold)
+	}
+
+	// Start the admin server
+	c.liveBytes = *confLiveBytes
+	if *confAdmin != "" {
+		err = c.startAdmin(*confAdmin)
+		if err != nil {
+			logger.Errorf("Failed to start admin server: %s", err)
+			os.Exit(ExitNetwork)
+		}
+	}
+
+	// Queue log lines for a background writer
+	if *confAsyncLog {
+		logger.SetOutput(NewAsyncWriter(logSink, 4096))
+	}
+	c.exitSummary = *confExitSummary
+
+	// Flush the queued logs, hook events and records, or log the summary,
+	// also when stopped by a signal
+	flush := *confAsyncLog || c.exitSummary || c.hooks != nil || c.records != nil
+	if flush && !c.poolGoroutine {
+		go c.shutdown() // Otherwise main waits for the signals
+	}
+
+	// Keep the local service health current for readiness
+	if c.readiness&ReadyBackend != 0 {
+		go c.probeBackend()
+	}
+
+	// Test the local service before serving
+	if *confCheckBackend || *confRequireBackend {
+		err = c.checkBackend()
+		switch {
+		case err == nil:
+			logger.Infof("Local service %s is reachable", c.laddr)
+		case *confRequireBackend:
+			logger.Errorf("Local service %s is unreachable: %s", c.laddr, err)
+			os.Exit(ExitNetwork)
+		default:
+			logger.Warningf("Local service %s is unreachable: %s", c.laddr, err)
 		}
 	}
 
 	c.logger.Infof("Proxying %s->%s", *confRaddr, *confLaddr)
+	c.logger.Infof("Remote network: %s", c.rnet)
+	for i, r := range c.relays {
+		c.logger.Infof("Proxy %d: %s", i+1, r)
+	}
 	return c
 }
 
-func (c *Context) worker(logger *Logger) {
+// shutdown terminates the process on SIGINT or SIGTERM
+func (c *Context) shutdown() {
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+	c.logger.Infof("Received %s, shutting down", <-sig)
+	c.exit(ExitOK)
+}
+
+// exit flushes the hook events, connection records and logs, waiting up
+// to the flush timeout, and terminates the process
+func (c *Context) exit(code int) {
+	deadline := time.Now().Add(c.flushTimeout)
+	hooks := c.hooks.Flush(deadline)
+	records := c.records.Flush(deadline)
+	if hooks > 0 || records > 0 {
+		c.logger.Warningf("Dropped %d hook events and %d connection records at exit",
+			hooks, records)
+	}
+	if c.exitSummary {
+		c.logger.Infof("Summary: %d connections, %d bytes sent, %d bytes received, "+
+			"%d remote connections, %d backoffs, uptime %s",
+			metricConnections.Value(), metricSent.Value(), metricRcvd.Value(),
+			metricRemote.Value(), metricBackoffs.Value(),
+			time.Since(c.started).Round(time.Second))
+	}
+	if lines := c.logger.Flush(deadline); lines > 0 {
+		fmt.Fprintf(os.Stderr, "Dropped %d log lines at exit\n", lines)
+	}
+	os.Exit(code)
+}
+
+// waitPending polls the counter of pending events until it drops to zero
+// or the deadline passes, and returns the last value
+func waitPending(pending *int64, deadline time.Time) int {
 	for {
-		delay := c.remote(false)
-		if delay != 0 {
-			ms := 1000 + rand.Intn(delay*1000)
+		n := atomic.LoadInt64(pending)
+		if n <= 0 || !time.Now().Before(deadline) {
+			return int(n)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func (c *Context) worker(w *Worker) {
+	attempt := 0 // Consecutive backoffs
+	for !w.isStopped() {
+		err := c.session(w)
+		b, ok := err.(*Backoff)
+		if !ok {
+			attempt = 0
+			continue
+		}
+		if !w.isStopped() {
+			attempt++
+			jitter := c.rand.Intn(b.Delay * 1000)
+			ms := 1000 + jitter
+			w.logger.Debugf("Backoff attempt %d after %s failure: %dms (1000ms + %dms of up to %dms jitter)",
+				attempt, b.Reason, ms, jitter, b.Delay*1000)
+			c.emitBackoff(w, b, ms)
 			time.Sleep(time.Duration(ms) * time.Millisecond)
 		}
 	}
 }
 
-// returns delay in seconds minus 1
-func (c *Context) remote(fast bool) int {
+// returns a *Backoff if reconnecting requires a delay,
+// w is nil for fast connections
+func (c *Context) remote(fast bool, w *Worker) error {
 	var logger *Logger
 	if fast {
 		logger = c.logger.Child("fast")
@@ -151,145 +1033,372 @@ func (c *Context) remote(fast bool) int {
 	}
 
 	// Dial rconn
-	rconn, err := net.Dial("tcp", c.raddr)
+	rconn, err := c.dialRemote()
 	if err != nil {
 		logger.Warningf("Remote connection failed: %s", err)
-		return 9
+		return backoff(9, "dial", err)
+	}
+	metricRemote.Inc()
+	w.attach(rconn)
+	s := &Session{
+		c:       c,
+		logger:  logger,
+		rconn:   rconn,
+		fast:    fast,
+		ropen:   true,
+		worker:  w,
+		started: time.Now(),
 	}
-	ropen := true
 	defer func() {
-		if ropen {
-			rconn.Close()
+		w.detach()
+		if s.ropen {
+			s.rconn.Close()
 		}
 	}()
 	err = rconn.SetDeadline(time.Now().Add(time.Minute))
 	if err != nil {
 		logger.Warningf("SetDeadline failed: %s", err)
-		return 99
+		return backoff(99, "deadline", err)
 	}
 
 	// Negotiate TLS
 	if c.tlsConfig == nil {
-		logger.Debugf("New TCP connection")
+		logger.Logf(c.connLogLevel(DEBUG), "New TCP connection")
 	} else {
 		conn := tls.Client(rconn, c.tlsConfig)
-		err = conn.Handshake() // Needed for ConnectionState()
+		err = c.handshake(conn) // Needed for ConnectionState()
+		if err != nil && c.tlsFallback && isNotTLS(err) {
+			logger.Warningf("Server does not support TLS, falling back to PLAINTEXT: %s", err)
+			rconn.Close()
+			return c.plaintext(s)
+		}
 		if err != nil {
 			logger.Warningf("TLS handshake failed: %s", err)
-			return 9
+			return backoff(9, "tls", err)
 		}
 		state := conn.ConnectionState()
-		v := state.Version
-		version := fmt.Sprintf("TLSv%d.%d", v>>8-2, v&255-1)
+		version := tlsVersionName(state.Version)
+		crypto := ""
+		if c.tlsLogCipher {
+			crypto = ", " + cipherSuiteName(state.CipherSuite)
+			if group := tlsGroupName(&state); group != "" {
+				crypto += ", " + group
+			}
+		}
 		if state.DidResume {
-			logger.Debugf("New %s connection (resumed session)", version)
+			logger.Logf(c.connLogLevel(DEBUG), "New %s connection (resumed session%s)", version, crypto)
 		} else {
-			logger.Infof("New %s connection (new session)", version)
+			logger.Logf(c.connLogLevel(INFO), "New %s connection (new session%s)", version, crypto)
+		}
+		if c.tlsDebug {
+			logConnectionState(logger, &state)
 		}
-		rconn = conn
+		if c.certExpiry != nil && !state.DidResume {
+			c.certExpiry.Check(logger, &state)
+		}
+		c.recordHandshake(logger, state.DidResume)
+		s.rconn = conn
+	}
+
+	return c.serve(s)
+}
+
+// connLogLevel returns the -conn-log-level if set, or level otherwise
+func (c *Context) connLogLevel(level Level) Level {
+	if c.connLevel != UNSPECIFIED {
+		return c.connLevel
+	}
+	return level
+}
+
+// plaintext redials the remote server without TLS for the session
+func (c *Context) plaintext(s *Session) error {
+	rconn, err := c.dialRemote()
+	if err != nil {
+		s.logger.Warningf("Remote connection failed: %s", err)
+		return backoff(9, "dial", err)
 	}
+	s.worker.attach(rconn)
+	s.rconn = rconn
+	err = rconn.SetDeadline(time.Now().Add(time.Minute))
+	if err != nil {
+		s.logger.Warningf("SetDeadline failed: %s", err)
+		return backoff(99, "deadline", err)
+	}
+	s.logger.Logf(c.connLogLevel(DEBUG), "New TCP connection")
+	return c.serve(s)
+}
 
-	// Send an authentication request
-	err = SndMsg(rconn, &Msg{Type: "listen", Port: c.port, Key: c.key})
+// serve authenticates the session and processes server messages
+func (c *Context) serve(s *Session) error {
+	logger, rconn, w := s.logger, s.rconn, s.worker
+
+	err := c.authenticate(s)
 	if err != nil {
-		logger.Warningf("Failed to send port number: %s", err)
-		return 9
+		return err
+	}
+	c.pool.connected(w)
+	metricReady.Add(1)
+	defer metricReady.Add(-1)
+
+	// Batch control messages written within the coalescing delay
+	if c.coalesce > 0 {
+		s.out = NewCoalescingWriter(rconn, c.coalesce)
+		defer s.out.Flush()
+	}
+
+	// Recycle fast connections waiting too long for work, or limit the
+	// wait for the first server message after LISTEN if set
+	var idleDeadline time.Time
+	if s.fast && c.fastIdle > 0 {
+		idleDeadline = time.Now().Add(c.fastIdle)
+		err = rconn.SetDeadline(idleDeadline)
+	} else if c.listenDeadline > 0 {
+		err = rconn.SetDeadline(time.Now().Add(c.listenDeadline))
+	}
+	if err != nil {
+		logger.Warningf("SetDeadline failed: %s", err)
+		return backoff(9, "deadline", err)
 	}
 
 	// Process server messages
 	for {
-		message, err := RcvMsg(rconn)
+		message, err := s.receive()
 		if err != nil {
-			logger.Warningf("Failed to receive message: %s", err)
-			return 9
-		}
-		switch message.Type {
-		case "start":
-			ropen = false // rconn will be closed by local()
-			go c.local(logger, message, rconn)
-			if fast { // Keep a steady pool of fast connections
-				go c.remote(true)
+			if w.isStopped() {
+				return nil
 			}
-			return 0
-		case "keepalive":
-			logger.Debugf("Received KEEPALIVE")
-			if fast {
-				err = SndMsg(rconn, &Msg{Type: "info", Text: "TIMEOUT"})
-				if err != nil {
-					logger.Warningf("Failed to send TIMEOUT: %s", err)
-				}
-				return 0
-			} else {
-				err = SndMsg(rconn, &Msg{Type: "keepalive"})
-				if err != nil {
-					logger.Warningf("Failed to send KEEPALIVE: %s", err)
-					return 9
-				}
-				err = rconn.SetDeadline(time.Now().Add(time.Minute))
-				if err != nil {
-					logger.Warningf("SetDeadline failed: %s", err)
-					return 9
-				}
+			if isTimeout(err) && !idleDeadline.IsZero() &&
+				!time.Now().Before(idleDeadline) {
+				logger.Debugf("Recycling idle fast connection")
+				return nil
 			}
-		case "debug":
-			logger.Debugf("%s", message.Text)
-			return 0
-		case "info":
-			logger.Infof("%s", message.Text)
-			return 0
-		case "warning":
-			logger.Warningf("%s", message.Text)
-			return 0
-		case "error":
-			logger.Errorf("%s", message.Text)
-			os.Exit(1)
-		default:
-			logger.Warningf("Ignored message: %s: %s", message.Type, message.Text)
+			logger.Warningf("Failed to receive message: %s", err)
+			return backoff(9, "receive", err)
+		}
+		if done, err := s.dispatch(message); done {
+			return err
 		}
 	}
 }
 
 func (c *Context) local(logger *Logger, message *Msg, rconn net.Conn) {
-	defer rconn.Close()
+	defer c.guard(logger, "local connection", nil)
+	defer closeConn(rconn, c.closeTimeout)
 
 	// Spawn an additional goroutines, ignore the result
-	if message.Fast {
-		go c.remote(true)
-		go c.remote(true)
+	if message.Fast && !c.simplePool {
+		go c.prewarm()
+		go c.prewarm()
 	}
 
 	// Use a dynamically generated connection id for further logs
-	logger = logger.Child(fmt.Sprintf("%d", <-c.connID))
-	if message.Fast {
+	id := c.nextConnID()
+	logger = logger.Child(fmt.Sprintf("%d", id))
+	if c.simplePool {
+		logger.Infof("Connection received from %s (fast flag %t ignored)",
+			message.Addr, message.Fast)
+	} else if message.Fast {
 		logger.Infof("Fast connection received from %s", message.Addr)
 	} else {
 		logger.Infof("Slow connection received from %s", message.Addr)
 	}
+	class := "slow"
+	if message.Fast {
+		class = "fast"
+	}
+	record := &ConnRecord{
+		ID:      id,
+		Start:   time.Now(),
+		Addr:    message.Addr,
+		Backend: c.laddr,
+		Class:   class,
+		Reason:  "error",
+	}
+	defer func() {
+		record.End = time.Now()
+		c.records.Add(record)
+	}()
+
+	// Refuse blocked sources before touching the local service
+	if c.blocklist != nil && c.blocklist.Blocked(message.Addr) {
+		logger.Infof("Blocked connection from %s", message.Addr)
+		record.Reason = ReasonBlocked
+		c.refuse(logger, rconn, ReasonBlocked)
+		return
+	}
+
+	// Refuse connections over the transfer quota
+	if c.quota != nil && c.quota.Remaining() == 0 {
+		logger.Infof("Transfer quota exceeded")
+		record.Reason = ReasonQuota
+		c.refuse(logger, rconn, ReasonQuota)
+		return
+	}
+
+	// Refuse sources over the concurrent connection limit
+	if c.sourceLimit != nil {
+		release, ok := c.sourceLimit.acquire(message.Addr)
+		if !ok {
+			logger.Infof("Too many connections from %s", message.Addr)
+			record.Reason = ReasonSourceLimit
+			c.refuse(logger, rconn, ReasonSourceLimit)
+			return
+		}
+		defer release()
+	}
+
+	// Use the local port selected by the server, if allowed
+	addr := c.laddr
+	if c.targetPorts != nil && message.Port != 0 {
+		if !c.targetPorts.contains(message.Port) {
+			logger.Warningf("Refused local port %d selected by the server", message.Port)
+			record.Reason = ReasonTargetPort
+			c.refuse(logger, rconn, ReasonTargetPort)
+			return
+		}
+		host, _, _ := net.SplitHostPort(c.laddr)
+		addr = net.JoinHostPort(host, strconv.Itoa(message.Port))
+		record.Backend = addr
+	}
+
+	// Select the backend by the first client bytes, which the server only
+	// forwards after SUCCESS
+	sni, routed := "", c.routes != nil
+	if routed {
+		err := c.sendSuccess(logger, rconn)
+		if err != nil {
+			logger.Warningf("Failed to send SUCCESS: %s", err)
+			return
+		}
+		rconn, addr, sni = c.route(logger, rconn, addr)
+		record.Backend = addr
+	}
 
 	// Dial lconn
 	logger.Infof("Connecting local service")
-	lconn, err := net.Dial("tcp", c.laddr)
+	lconn, err := c.dialLocalRetry(logger, addr, sni)
+	if err == errLocalDialSlot {
+		logger.Warningf("No local dial slot within %s", c.localDialWait)
+		record.Reason = ReasonLocalDialSlot
+		if !routed {
+			c.refuse(logger, rconn, ReasonLocalDialSlot)
+		}
+		return
+	}
+	connected := time.Now()
+	backend := c.backendFor(addr)
+	backend.record(err)
 	if err != nil {
 		logger.Warningf("Local connection failed: %s", err)
+		record.Reason = ReasonLocalDial
+		if !routed {
+			c.refuse(logger, rconn, ReasonLocalDial)
+		}
 		return
 	}
-	defer lconn.Close()
+	defer closeConn(lconn, c.closeTimeout)
+	defer backend.acquire()()
+	record.Dialed = lconn.RemoteAddr().String()
+	logger.Infof("Connected local service %s at %s", addr, record.Dialed)
 	err = lconn.SetDeadline(time.Now().Add(time.Minute))
 	if err != nil {
 		logger.Warningf("SetDeadline failed: %s", err)
+		record.Reason = ReasonLocalDeadline
+		if !routed {
+			c.refuse(logger, rconn, ReasonLocalDeadline)
+		}
 		return
 	}
 
+	// Report the local TLS connection before any data is forwarded
+	if c.localTLSReport {
+		err = SndMsg(rconn, &Msg{Type: "info", Text: localTLSReport(lconn)})
+		if err != nil {
+			logger.Warningf("Failed to send local TLS report: %s", err)
+			return
+		}
+	}
+
 	// Send SUCCESS
-	err = SndMsg(rconn, &Msg{Type: "success"})
-	if err != nil {
-		logger.Warningf("Failed to send SUCCESS: %s", err)
-		return
+	if !routed {
+		err = c.sendSuccess(logger, rconn)
+		if err != nil {
+			logger.Warningf("Failed to send SUCCESS: %s", err)
+			return
+		}
 	}
 
 	// Forward the data
-	p := GetProxy(logger)
+	env := []string{
+		fmt.Sprintf("B4CK_CONN_ID=%d", id),
+		"B4CK_ADDR=" + message.Addr,
+		"B4CK_BACKEND=" + addr,
+		"B4CK_CLASS=" + class,
+	}
+	c.onConnect.Run(logger, env...)
+	p := GetProxy(logger, c.closeOrder)
+	p.class = class
+	p.closeWriteReset = c.closeWriteReset
+	p.firstByte = c.firstByte
+	p.readSizes = c.readSizes
+	p.failFast = c.failFast
+	p.live = (c.liveBytes && c.active != nil) || c.quota != nil
+	p.quota = c.quota
+	remove := c.active.add(record, p)
 	p.Transfer(rconn, lconn)
+	remove()
+	sent, rcvd := p.Bytes()
+	c.onClose.Run(logger, append(env,
+		fmt.Sprintf("B4CK_SENT=%d", sent),
+		fmt.Sprintf("B4CK_RCVD=%d", rcvd))...)
+	record.Sent, record.Received, record.Reason = sent, rcvd, "closed"
+	metricConnections.Inc()
+	metricSent.Add(uint64(sent))
+	metricRcvd.Add(uint64(rcvd))
+	metricTunnelConnections.With(c.tunnel, addr).Inc()
+	metricTunnelSent.With(c.tunnel, addr).Add(uint64(sent))
+	metricTunnelRcvd.With(c.tunnel, addr).Add(uint64(rcvd))
+	metricClassConnections.With(class).Inc()
+	metricClassSent.With(class).Add(uint64(sent))
+	metricClassRcvd.With(class).Add(uint64(rcvd))
+	metricClassConnect.With(class).Add(uint64(connected.Sub(record.Start) / time.Millisecond))
+	metricClassDuration.With(class).Add(uint64(time.Since(record.Start) / time.Millisecond))
+	if c.quota != nil && c.quota.Remaining() == 0 && c.quotaExit {
+		logger.Errorf("Transfer quota exceeded, exiting")
+		c.exit(ExitQuota)
+	}
+}
+
+// nextConnID returns a new connection id, increasing monotonically
+// or wrapping to 0 at connIDMax if set
+func (c *Context) nextConnID() uint64 {
+	id := atomic.AddUint64(&c.connID, 1) - 1
+	if c.connIDMax > 0 {
+		id %= c.connIDMax
+	}
+	return id
+}
+
+// sendSuccess sends SUCCESS, after the -debug-success-delay if set
+func (c *Context) sendSuccess(logger *Logger, rconn net.Conn) error {
+	delay := c.debugSuccessDelay
+	if c.debugSuccessJitter > 0 {
+		delay += time.Duration(c.rand.Int63n(int64(c.debugSuccessJitter)))
+	}
+	if delay > 0 {
+		logger.Infof("Delaying SUCCESS by %s (-debug-success-delay)", delay)
+		time.Sleep(delay)
+	}
+	return SndMsg(rconn, &Msg{Type: "success"})
+}
+
+// refuse reports to the server why a connection is closed without forwarding
+func (c *Context) refuse(logger *Logger, rconn net.Conn, reason string) {
+	err := SndMsg(rconn, CloseMsg(reason))
+	if err != nil {
+		logger.Warningf("Failed to send close reason: %s", err)
+	}
 }
 
 // vim: noet:ts=4:sw=4:sts=4:spell
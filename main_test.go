@@ -0,0 +1,79 @@
+/*
+ *  b4ck-client
+ *  Copyright 2020 Michał Trojnara
+
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU General Public License as published by
+ *  the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU General Public License for more details.
+
+ *  You should have received a copy of the GNU General Public License
+ *  along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+func TestExitCodes(t *testing.T) {
+	codes := []struct {
+		name string
+		code int
+	}{
+		{"ExitOK", ExitOK},
+		{"ExitFailure", ExitFailure},
+		{"ExitConfig", ExitConfig},
+		{"ExitServer", ExitServer},
+		{"ExitNetwork", ExitNetwork},
+		{"ExitQuota", ExitQuota},
+	}
+	readme, err := ioutil.ReadFile("README.md")
+	if err != nil {
+		t.Fatalf("Failed to read README.md: %s", err)
+	}
+	seen := make(map[int]string)
+	for _, c := range codes {
+		if other, ok := seen[c.code]; ok {
+			t.Errorf("%s and %s share exit code %d", c.name, other, c.code)
+		}
+		seen[c.code] = c.name
+		if !strings.Contains(string(readme), fmt.Sprintf("\n    %d  ", c.code)) {
+			t.Errorf("%s (%d) is not documented in README.md", c.name, c.code)
+		}
+	}
+}
+
+func TestExitCodesUsed(t *testing.T) {
+	files, err := filepath.Glob("*.go")
+	if err != nil {
+		t.Fatal(err)
+	}
+	literal := regexp.MustCompile(`os\.Exit\([0-9]`)
+	for _, file := range files {
+		if strings.HasSuffix(file, "_test.go") {
+			continue
+		}
+		source, err := ioutil.ReadFile(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if loc := literal.FindIndex(source); loc != nil {
+			line := 1 + strings.Count(string(source[:loc[0]]), "\n")
+			t.Errorf("%s:%d: exit code not named by a constant", file, line)
+		}
+	}
+}
+
+// vim: noet:ts=4:sw=4:sts=4:spell
@@ -0,0 +1,188 @@
+/*
+ *  b4ck-client
+ *  Copyright 2020 Michał Trojnara
+
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU General Public License as published by
+ *  the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU General Public License for more details.
+
+ *  You should have received a copy of the GNU General Public License
+ *  along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// Registry holds the exported metrics
+type Registry struct {
+	mu      sync.Mutex
+	metrics []*metric
+}
+
+type metric struct {
+	name  string
+	help  string
+	kind  string
+	value func() float64
+	vec   *CounterVec // Instead of value for labeled counters
+}
+
+var metrics = &Registry{}
+
+// Counter is a monotonically increasing metric
+type Counter struct {
+	value uint64
+}
+
+// Add increases the counter by n
+func (c *Counter) Add(n uint64) {
+	atomic.AddUint64(&c.value, n)
+}
+
+// Inc increases the counter by 1
+func (c *Counter) Inc() {
+	c.Add(1)
+}
+
+// Value returns the current counter value
+func (c *Counter) Value() uint64 {
+	return atomic.LoadUint64(&c.value)
+}
+
+// Gauge is a metric that can go up and down
+type Gauge struct {
+	value int64
+}
+
+// Set sets the gauge to v
+func (g *Gauge) Set(v int64) {
+	atomic.StoreInt64(&g.value, v)
+}
+
+// Add adds delta (possibly negative) to the gauge
+func (g *Gauge) Add(delta int64) {
+	atomic.AddInt64(&g.value, delta)
+}
+
+// Value returns the current gauge value
+func (g *Gauge) Value() int64 {
+	return atomic.LoadInt64(&g.value)
+}
+
+// CounterVec is a set of counters distinguished by label values
+type CounterVec struct {
+	labels   []string
+	mu       sync.Mutex
+	counters map[string]*Counter // Keyed by the rendered label set
+	keys     []string            // In creation order
+}
+
+// labelEscaper escapes a label value in the Prometheus text format
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// With returns the counter for the label values, creating it if needed
+func (v *CounterVec) With(values ...string) *Counter {
+	pairs := make([]string, len(v.labels))
+	for i, label := range v.labels {
+		value := ""
+		if i < len(values) {
+			value = values[i]
+		}
+		pairs[i] = fmt.Sprintf("%s=\"%s\"", label, labelEscaper.Replace(value))
+	}
+	key := "{" + strings.Join(pairs, ",") + "}"
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	c, ok := v.counters[key]
+	if !ok {
+		c = &Counter{}
+		v.counters[key] = c
+		v.keys = append(v.keys, key)
+	}
+	return c
+}
+
+// NewCounter registers a new counter
+func (r *Registry) NewCounter(name, help string) *Counter {
+	c := &Counter{}
+	r.register(name, help, "counter", func() float64 {
+		return float64(c.Value())
+	})
+	return c
+}
+
+// NewGauge registers a new gauge
+func (r *Registry) NewGauge(name, help string) *Gauge {
+	g := &Gauge{}
+	r.register(name, help, "gauge", func() float64 {
+		return float64(g.Value())
+	})
+	return g
+}
+
+// NewCounterVec registers a new set of counters with the given labels
+func (r *Registry) NewCounterVec(name, help string, labels ...string) *CounterVec {
+	v := &CounterVec{labels: labels, counters: make(map[string]*Counter)}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.metrics = append(r.metrics, &metric{
+		name: name,
+		help: help,
+		kind: "counter",
+		vec:  v,
+	})
+	return v
+}
+
+// NewGaugeFunc registers a gauge computed on demand
+func (r *Registry) NewGaugeFunc(name, help string, value func() float64) {
+	r.register(name, help, "gauge", value)
+}
+
+func (r *Registry) register(name, help, kind string, value func() float64) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.metrics = append(r.metrics, &metric{
+		name:  name,
+		help:  help,
+		kind:  kind,
+		value: value,
+	})
+}
+
+// WriteText writes the metrics in the Prometheus text format
+func (r *Registry) WriteText(w io.Writer) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	b := bufio.NewWriter(w)
+	for _, m := range r.metrics {
+		fmt.Fprintf(b, "# HELP %s %s\n", m.name, m.help)
+		fmt.Fprintf(b, "# TYPE %s %s\n", m.name, m.kind)
+		if m.vec == nil {
+			fmt.Fprintf(b, "%s %g\n", m.name, m.value())
+			continue
+		}
+		m.vec.mu.Lock()
+		for _, key := range m.vec.keys {
+			fmt.Fprintf(b, "%s%s %d\n", m.name, key, m.vec.counters[key].Value())
+		}
+		m.vec.mu.Unlock()
+	}
+	return b.Flush()
+}
+
+// vim: noet:ts=4:sw=4:sts=4:spell
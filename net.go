@@ -19,21 +19,54 @@
 package main
 
 import (
-	// "fmt"
+	"fmt"
 	"io"
+	"net"
+	"strings"
 
 	"github.com/json-iterator/go"
 )
 
 var json = jsoniter.ConfigFastest
 
+// MaxMsgLen is the maximum length of a serialized message
+const MaxMsgLen = 255
+
 type Msg struct {
-	Type string
-	Text string `json:",omitempty"`
-	Port int    `json:",omitempty"`
-	Key  []byte `json:",omitempty"`
-	Fast bool   `json:",omitempty"`
-	Addr string `json:",omitempty"`
+	Type    string
+	Text    string `json:",omitempty"`
+	Port    int    `json:",omitempty"`
+	Key     []byte `json:",omitempty"`
+	Fast    bool   `json:",omitempty"`
+	Addr    string `json:",omitempty"`
+	Reason  string `json:",omitempty"`
+	Tag     string `json:",omitempty"`
+	Auth    string `json:",omitempty"`
+	Nonce   []byte `json:",omitempty"`
+	Framing string `json:",omitempty"`
+	Workers int    `json:",omitempty"`
+}
+
+// Reasons reported to the server for connections closed before forwarding
+const (
+	ReasonBlocked       = "blocked"
+	ReasonLocalDial     = "local_dial"
+	ReasonLocalDialSlot = "local_dial_slot"
+	ReasonLocalDeadline = "local_deadline"
+	ReasonQuota         = "quota"
+	ReasonSourceLimit   = "source_limit"
+	ReasonTargetPort    = "target_port"
+)
+
+// CloseMsg returns an info message reporting why a connection was closed
+func CloseMsg(reason string) *Msg {
+	return &Msg{Type: "info", Text: strings.ToUpper(reason), Reason: reason}
+}
+
+// isTimeout reports whether err is a network timeout
+func isTimeout(err error) bool {
+	netErr, ok := err.(net.Error)
+	return ok && netErr.Timeout()
 }
 
 func RcvMsg(r io.Reader) (*Msg, error) {
@@ -53,14 +86,193 @@ func RcvMsg(r io.Reader) (*Msg, error) {
 }
 
 func SndMsg(w io.Writer, m *Msg) error {
-	serialized, err := json.Marshal(m)
+	serialized, err := marshalMsg(m)
 	if err != nil {
 		return err
 	}
-	// fmt.Println(string(serialized))
 	length := []byte{byte(len(serialized))}
-	_, err = w.Write(append(length, serialized...))
-	return err
+	return writeFull(w, append(length, serialized...))
+}
+
+// writeFull writes all of b, repeating short writes, so that a message
+// is never silently truncated
+func writeFull(w io.Writer, b []byte) error {
+	total := len(b)
+	for len(b) > 0 {
+		n, err := w.Write(b)
+		b = b[n:]
+		if err != nil {
+			return err
+		}
+		if n == 0 {
+			return fmt.Errorf("wrote %d of %d bytes: %w", total-len(b), total, io.ErrShortWrite)
+		}
+	}
+	return nil
+}
+
+func marshalMsg(m *Msg) ([]byte, error) {
+	serialized, err := json.Marshal(m)
+	if err != nil {
+		return nil, err
+	}
+	// fmt.Println(string(serialized))
+	if len(serialized) > MaxMsgLen {
+		return nil, fmt.Errorf("message too long: %d bytes", len(serialized))
+	}
+	return serialized, nil
+}
+
+// RcvTolerantMsg receives a message, also accepting a JSON object sent
+// without the length prefix; it reports whether the prefix was missing
+func RcvTolerantMsg(r io.Reader) (*Msg, bool, error) {
+	var m Msg
+	head := make([]byte, 2)
+
+	// Skip the line breaks following an unprefixed message.  They are never
+	// a length prefix, as the shortest message {"Type":""} has 11 bytes.
+	for {
+		_, err := io.ReadFull(r, head[:1])
+		if err != nil {
+			return &m, false, err
+		}
+		if head[0] != '\n' && head[0] != '\r' && head[0] != '\t' {
+			break
+		}
+	}
+	_, err := io.ReadFull(r, head[1:])
+	if err != nil {
+		return &m, false, err
+	}
+
+	// A length of 123 ('{') is followed by '{', unlike an unprefixed object
+	if head[0] != '{' || head[1] == '{' {
+		serialized := make([]byte, head[0])
+		if len(serialized) > 0 {
+			serialized[0] = head[1]
+			_, err = io.ReadFull(r, serialized[1:])
+			if err != nil {
+				return &m, false, err
+			}
+		}
+		err = json.Unmarshal(serialized, &m)
+		return &m, false, err
+	}
+
+	// Read up to the matching closing brace, one byte at a time so that
+	// no data following the message is consumed
+	serialized := []byte{head[0]}
+	depth, quoted, escaped := 1, false, false
+	b := head[1:]
+	for {
+		serialized = append(serialized, b[0])
+		switch {
+		case escaped:
+			escaped = false
+		case quoted && b[0] == '\\':
+			escaped = true
+		case b[0] == '"':
+			quoted = !quoted
+		case !quoted && b[0] == '{':
+			depth++
+		case !quoted && b[0] == '}':
+			depth--
+		}
+		if depth == 0 {
+			break
+		}
+		if len(serialized) >= 16*MaxMsgLen {
+			return &m, true, fmt.Errorf("unprefixed message too long")
+		}
+		_, err = io.ReadFull(r, b)
+		if err != nil {
+			return &m, true, err
+		}
+	}
+	err = json.Unmarshal(serialized, &m)
+	return &m, true, err
+}
+
+// FramingSync requests sync frames from the server in the listen message.
+// Sync frames start with a magic prefix, so that the receiver can find the
+// next frame boundary after corrupted input.  The second magic byte is not
+// '{', which tells sync frames from length-prefixed ones, so the server may
+// ignore the request.  The client always sends length-prefixed frames.
+const FramingSync = "sync"
+
+const (
+	syncMagic0 = 0xb4
+	syncMagic1 = 0xc4
+)
+
+// SndSyncMsg sends a message in a sync frame
+func SndSyncMsg(w io.Writer, m *Msg) error {
+	serialized, err := marshalMsg(m)
+	if err != nil {
+		return err
+	}
+	header := []byte{syncMagic0, syncMagic1, byte(len(serialized))}
+	return writeFull(w, append(header, serialized...))
+}
+
+// RcvSyncMsg receives a message in either framing; after corrupted input
+// it skips to the next valid sync frame and returns the bytes skipped
+func RcvSyncMsg(r io.Reader) (*Msg, int, error) {
+	var m Msg
+	head := make([]byte, 2)
+	_, err := io.ReadFull(r, head)
+	if err != nil {
+		return &m, 0, err
+	}
+	skipped := 0
+	if head[1] == '{' && head[0] > 1 { // Length-prefixed frame
+		serialized := make([]byte, head[0])
+		serialized[0] = '{'
+		_, err = io.ReadFull(r, serialized[1:])
+		if err != nil {
+			return &m, 0, err
+		}
+		if json.Unmarshal(serialized, &m) == nil {
+			return &m, 0, nil
+		}
+		m = Msg{}
+		skipped += 1 + len(serialized)
+		_, err = io.ReadFull(r, head)
+		if err != nil {
+			return &m, skipped, err
+		}
+	}
+	next := head[1:]
+	for {
+		if head[0] == syncMagic0 && head[1] == syncMagic1 {
+			length := make([]byte, 1)
+			_, err = io.ReadFull(r, length)
+			if err != nil {
+				return &m, skipped, err
+			}
+			serialized := make([]byte, length[0])
+			_, err = io.ReadFull(r, serialized)
+			if err != nil {
+				return &m, skipped, err
+			}
+			if json.Unmarshal(serialized, &m) == nil {
+				return &m, skipped, nil
+			}
+			m = Msg{}
+			skipped += len(head) + len(length) + len(serialized)
+			_, err = io.ReadFull(r, head)
+			if err != nil {
+				return &m, skipped, err
+			}
+			continue
+		}
+		skipped++
+		head[0] = head[1]
+		_, err = io.ReadFull(r, next)
+		if err != nil {
+			return &m, skipped, err
+		}
+	}
 }
 
 // vim: noet:ts=4:sw=4:sts=4:spell
@@ -0,0 +1,151 @@
+/*
+ *  b4ck-client
+ *  Copyright 2020 Michał Trojnara
+
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU General Public License as published by
+ *  the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU General Public License for more details.
+
+ *  You should have received a copy of the GNU General Public License
+ *  along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"testing"
+)
+
+// testMessages returns the self-test messages, failing t on errors
+func testMessages(t *testing.T) []*Msg {
+	t.Helper()
+	messages, err := representativeMessages()
+	if err != nil {
+		t.Fatalf("Failed to serialize: %s", err)
+	}
+	return messages
+}
+
+// checkMsg fails t if rcvd differs from sent
+func checkMsg(t *testing.T, sent, rcvd *Msg) {
+	t.Helper()
+	for _, diff := range diffMsg(sent, rcvd) {
+		t.Errorf("%s: %s", sent.Type, diff)
+	}
+}
+
+// shortWriter writes at most max bytes per call without reporting errors
+type shortWriter struct {
+	w   io.Writer
+	max int
+}
+
+func (s *shortWriter) Write(b []byte) (int, error) {
+	if len(b) > s.max {
+		b = b[:s.max]
+	}
+	return s.w.Write(b)
+}
+
+func TestSndMsgShortWrites(t *testing.T) {
+	for _, sent := range testMessages(t) {
+		var buf bytes.Buffer
+		err := SndMsg(&shortWriter{w: &buf, max: 7}, sent)
+		if err == nil {
+			err = SndSyncMsg(&shortWriter{w: &buf, max: 7}, sent)
+		}
+		if err != nil {
+			t.Errorf("%s: failed to send with short writes: %s", sent.Type, err)
+			continue
+		}
+		rcvd, err := RcvMsg(&buf)
+		if err != nil {
+			t.Errorf("%s: failed to receive: %s", sent.Type, err)
+			continue
+		}
+		checkMsg(t, sent, rcvd)
+		rcvd, _, err = RcvSyncMsg(&buf)
+		if err != nil {
+			t.Errorf("%s: failed to receive sync frame: %s", sent.Type, err)
+			continue
+		}
+		checkMsg(t, sent, rcvd)
+	}
+}
+
+func TestSndMsgStalledWriter(t *testing.T) {
+	var buf bytes.Buffer
+	err := SndMsg(&shortWriter{w: &buf, max: 0}, &Msg{Type: "keepalive"})
+	if !errors.Is(err, io.ErrShortWrite) {
+		t.Errorf("Stalled write was not reported: %v", err)
+	}
+}
+
+func TestRcvSyncMsgResync(t *testing.T) {
+	corrupted := []byte{0x00, '{', syncMagic0, syncMagic0, syncMagic1, 3, 'x', 'x', 'x'}
+	for _, sent := range testMessages(t) {
+		var buf bytes.Buffer
+		err := SndMsg(&buf, sent) // Length-prefixed frames are also accepted
+		if err == nil {
+			buf.Write(corrupted)
+			err = SndSyncMsg(&buf, sent)
+		}
+		if err != nil {
+			t.Fatalf("%s: failed to send: %s", sent.Type, err)
+		}
+		for _, expected := range []int{0, len(corrupted)} {
+			rcvd, skipped, err := RcvSyncMsg(&buf)
+			if err != nil {
+				t.Errorf("%s: failed to receive sync frame: %s", sent.Type, err)
+				break
+			}
+			if skipped != expected {
+				t.Errorf("%s: skipped %d bytes, expected %d", sent.Type, skipped, expected)
+			}
+			checkMsg(t, sent, rcvd)
+		}
+	}
+}
+
+func TestRcvTolerantMsg(t *testing.T) {
+	// Alternate prefixed and unprefixed messages in a single stream, so
+	// that the line breaks after unprefixed messages must be skipped
+	messages := testMessages(t)
+	var buf bytes.Buffer
+	for i, sent := range messages {
+		err := SndMsg(&buf, sent)
+		if err != nil {
+			t.Fatalf("%s: failed to send: %s", sent.Type, err)
+		}
+		err = json.NewEncoder(&buf).Encode(sent) // Unprefixed, with '\n'
+		if err != nil {
+			t.Fatalf("%s: failed to encode: %s", sent.Type, err)
+		}
+		if i%2 == 1 {
+			buf.WriteString("\r\n\t")
+		}
+	}
+	for _, sent := range messages {
+		for _, expected := range []bool{false, true} {
+			rcvd, unprefixed, err := RcvTolerantMsg(&buf)
+			if err != nil {
+				t.Fatalf("%s: failed to receive tolerant frame: %s", sent.Type, err)
+			}
+			if unprefixed != expected {
+				t.Errorf("%s: unprefixed %t, expected %t", sent.Type, unprefixed, expected)
+			}
+			checkMsg(t, sent, rcvd)
+		}
+	}
+}
+
+// vim: noet:ts=4:sw=4:sts=4:spell
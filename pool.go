@@ -0,0 +1,375 @@
+/*
+ *  b4ck-client
+ *  Copyright 2020 Michał Trojnara
+
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU General Public License as published by
+ *  the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU General Public License for more details.
+
+ *  You should have received a copy of the GNU General Public License
+ *  along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Worker is a slow connection worker supervised by a Pool
+type Worker struct {
+	active    int64 // Last activity in Unix nanoseconds, accessed atomically
+	id        int
+	permanent bool
+	logger    *Logger
+
+	mu      sync.Mutex
+	stopped bool
+	conn    net.Conn // Control connection closed on stop
+}
+
+// touch records activity of the worker
+func (w *Worker) touch() {
+	if w == nil {
+		return
+	}
+	atomic.StoreInt64(&w.active, time.Now().UnixNano())
+}
+
+func (w *Worker) idleFor(now time.Time) time.Duration {
+	return now.Sub(time.Unix(0, atomic.LoadInt64(&w.active)))
+}
+
+// attach registers the control connection to be closed on stop
+func (w *Worker) attach(conn net.Conn) {
+	if w == nil {
+		return
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.stopped {
+		conn.Close()
+		return
+	}
+	w.conn = conn
+}
+
+// detach unregisters the control connection, and reports false
+// if the worker was already stopped and the connection closed
+func (w *Worker) detach() bool {
+	if w == nil {
+		return true
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.conn = nil
+	return !w.stopped
+}
+
+func (w *Worker) stop() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.stopped = true
+	if w.conn != nil {
+		w.conn.Close()
+	}
+}
+
+// isStopped reports whether the worker was stopped by its Pool
+func (w *Worker) isStopped() bool {
+	if w == nil {
+		return false
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.stopped
+}
+
+// WorkerNaming is the scheme of worker names used in logs
+type WorkerNaming int
+
+// Worker naming schemes
+const (
+	NameNumber WorkerNaming = iota // "7"
+	NamePadded                     // "07" for up to 100 workers
+	NameRandom                     // "7-3f9a", distinct across restarts
+)
+
+var workerNamingNames = map[string]WorkerNaming{
+	"number": NameNumber,
+	"padded": NamePadded,
+	"random": NameRandom,
+}
+
+// ParseWorkerNaming converts a naming scheme name into a WorkerNaming
+func ParseWorkerNaming(name string) (WorkerNaming, error) {
+	naming, ok := workerNamingNames[name]
+	if !ok {
+		return NameNumber, fmt.Errorf("unknown worker naming %q", name)
+	}
+	return naming, nil
+}
+
+// Pool supervises the slow connection workers, and scales down workers
+// idle for longer than idle toward min, and back up to size on demand
+type Pool struct {
+	c       *Context
+	size    int
+	min     int
+	idle    time.Duration
+	mu      sync.Mutex
+	workers map[int]*Worker
+	naming  WorkerNaming
+	shuffle bool // Start workers in random order
+
+	// Readiness event, see connected
+	quorum int
+	ready  map[int]bool // Until the quorum is reached
+
+	// Prewarm ramp, see connected
+	warm map[int]bool // Until all workers are connected
+
+	// Startup fill report, see connected
+	fillWindow time.Duration
+	fillStart  time.Time
+	filled     map[int]bool
+	fillDone   bool
+}
+
+// NewPool returns a new Pool of size workers
+func NewPool(c *Context, size, min int, idle time.Duration) *Pool {
+	return &Pool{
+		c:       c,
+		size:    size,
+		min:     min,
+		idle:    idle,
+		workers: make(map[int]*Worker),
+		quorum:  1,
+		ready:   make(map[int]bool),
+		warm:    make(map[int]bool),
+		filled:  make(map[int]bool),
+	}
+}
+
+// Run starts the workers with staggered startup, and runs the last
+// worker on the calling goroutine
+func (p *Pool) Run() {
+	p.mu.Lock()
+	p.fillStart = time.Now()
+	if p.fillWindow > 0 {
+		time.AfterFunc(p.fillWindow, p.reportFill)
+	} else {
+		p.fillDone = true
+	}
+	size := p.size
+	first := p.addLocked(0, true)
+	if p.c.readiness&ReadyControl == 0 {
+		p.ready = nil // Only the local service is awaited
+		go p.c.emitReady(size)
+	}
+	p.mu.Unlock()
+
+	ids := make([]int, 0, size)
+	for i := size - 1; i > 0; i-- {
+		ids = append(ids, i)
+	}
+	if p.shuffle {
+		p.c.rand.Shuffle(len(ids), func(i, j int) { ids[i], ids[j] = ids[j], ids[i] })
+	}
+	for _, i := range ids {
+		if w := p.add(i); w != nil {
+			go p.c.worker(w)
+		}
+		time.Sleep(time.Duration(900+p.c.rand.Int31n(200)) * time.Millisecond)
+	}
+	if p.min < size {
+		go p.supervise()
+	}
+	p.c.worker(first)
+}
+
+// add returns a new worker, or nil if the pool was resized by the server
+// so that the worker is already running or no longer needed
+func (p *Pool) add(id int) *Worker {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.workers[id] != nil || id >= p.size {
+		return nil
+	}
+	return p.addLocked(id, false)
+}
+
+func (p *Pool) addLocked(id int, permanent bool) *Worker {
+	w := &Worker{
+		id:        id,
+		permanent: permanent,
+		logger:    p.c.logger.Child(p.workerName(id)),
+	}
+	w.touch()
+	p.workers[id] = w
+	return w
+}
+
+// workerName returns the logger name of worker id
+func (p *Pool) workerName(id int) string {
+	switch p.naming {
+	case NamePadded:
+		width := len(fmt.Sprintf("%d", p.c.poolMax-1))
+		return fmt.Sprintf("%0*d", width, id)
+	case NameRandom:
+		return fmt.Sprintf("%d-%04x", id, rand.Intn(0x10000))
+	}
+	return fmt.Sprintf("%d", id)
+}
+
+// connected records the first connection of each worker, emits the ready
+// event once quorum workers are connected, ramps up the startup prewarms,
+// and logs a summary once all workers are connected or the fill window
+// elapses
+func (p *Pool) connected(w *Worker) {
+	if w == nil {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.ready != nil {
+		p.ready[w.id] = true
+		if len(p.ready) >= p.quorum || len(p.ready) >= p.size {
+			p.ready = nil
+			go p.c.emitReady(p.size)
+		}
+	}
+	if p.warm != nil {
+		p.warm[w.id] = true
+		p.c.prewarmLimit.workerConnected(len(p.warm), p.size)
+		if len(p.warm) >= p.size {
+			p.warm = nil
+		}
+	}
+	if p.fillDone {
+		return
+	}
+	p.filled[w.id] = true
+	if len(p.filled) >= p.size {
+		p.reportFillLocked()
+	}
+}
+
+func (p *Pool) reportFill() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if !p.fillDone {
+		p.reportFillLocked()
+	}
+}
+
+func (p *Pool) reportFillLocked() {
+	p.fillDone = true
+	elapsed := time.Since(p.fillStart)
+	rate := float64(len(p.filled)) / elapsed.Seconds()
+	if len(p.filled) >= p.size {
+		p.c.logger.Infof("Worker pool filled: %d connections in %s (%.2f/s)",
+			len(p.filled), elapsed.Round(time.Millisecond), rate)
+	} else {
+		p.c.logger.Warningf("Worker pool not filled after %s: %d of %d connections (%.2f/s)",
+			elapsed.Round(time.Millisecond), len(p.filled), p.size, rate)
+	}
+}
+
+// resize changes the number of workers, stopping the workers over the new
+// size and starting the missing ones
+func (p *Pool) resize(size int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if size == p.size {
+		return
+	}
+	p.c.logger.Infof("Resizing worker pool from %d to %d", p.size, size)
+	p.size = size
+	for id, w := range p.workers {
+		if id >= size && !w.permanent {
+			delete(p.workers, id)
+			w.logger.Infof("Stopping worker (%d running)", len(p.workers))
+			w.stop()
+		}
+	}
+	for id := 0; id < size; id++ {
+		if p.workers[id] == nil {
+			w := p.addLocked(id, false)
+			w.logger.Infof("Starting worker (%d running)", len(p.workers))
+			go p.c.worker(w)
+		}
+	}
+}
+
+func (p *Pool) supervise() {
+	interval := p.idle / 2
+	if interval < time.Second {
+		interval = time.Second
+	}
+	for range time.Tick(interval) {
+		p.scale()
+	}
+}
+
+// scale stops idle workers, or starts a new worker if all are busy
+func (p *Pool) scale() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	now := time.Now()
+	busy := 0
+	var idle []*Worker
+	for _, w := range p.workers {
+		if w.idleFor(now) <= p.idle {
+			busy++
+		} else if !w.permanent {
+			idle = append(idle, w)
+		}
+	}
+
+	if busy == len(p.workers) && len(p.workers) < p.size {
+		id := 0
+		for p.workers[id] != nil {
+			id++
+		}
+		w := p.addLocked(id, false)
+		w.logger.Infof("Starting worker (%d running)", len(p.workers))
+		go p.c.worker(w)
+		return
+	}
+
+	for _, w := range idle {
+		if len(p.workers) <= p.min {
+			break
+		}
+		delete(p.workers, w.id)
+		w.logger.Infof("Stopping idle worker (%d running)", len(p.workers))
+		w.stop()
+	}
+}
+
+// emitReady reports that the pool is connected and ready to serve, once
+// the local service is reachable if required
+func (c *Context) emitReady(workers int) {
+	c.waitBackend()
+	c.logger.Infof("Ready: remote=%s port=%d local=%s workers=%d",
+		c.raddr, c.port, c.laddr, workers)
+	c.onReady.Run(c.logger,
+		"B4CK_REMOTE="+c.raddr,
+		fmt.Sprintf("B4CK_PORT=%d", c.port),
+		"B4CK_LOCAL="+c.laddr,
+		fmt.Sprintf("B4CK_WORKERS=%d", workers))
+}
+
+// vim: noet:ts=4:sw=4:sts=4:spell
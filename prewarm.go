@@ -0,0 +1,115 @@
+/*
+ *  b4ck-client
+ *  Copyright 2020 Michał Trojnara
+
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU General Public License as published by
+ *  the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU General Public License for more details.
+
+ *  You should have received a copy of the GNU General Public License
+ *  along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// StartupLimiter caps the prewarm connections initiated until the pool
+// stabilizes, so that the startup burst does not trip server rate limits.
+// Each connected worker allows one more prewarm, and the limit is lifted
+// once all workers are connected or the window elapses.
+type StartupLimiter struct {
+	mu        sync.Mutex
+	until     time.Time
+	max       int
+	started   int
+	connected int
+	released  bool
+	queued    int
+	changed   chan struct{} // Closed and replaced when a slot may be free
+}
+
+// NewStartupLimiter returns a limiter allowing max prewarms within window
+func NewStartupLimiter(max int, window time.Duration) *StartupLimiter {
+	return &StartupLimiter{
+		until:   time.Now().Add(window),
+		max:     max,
+		changed: make(chan struct{}),
+	}
+}
+
+// wait blocks until a prewarm may start, and returns the number of
+// prewarms queued so far if this one had to wait, or 0; it never blocks
+// on a nil StartupLimiter
+func (l *StartupLimiter) wait() int {
+	if l == nil {
+		return 0
+	}
+	queued := 0
+	l.mu.Lock()
+	for !l.released && l.started >= l.max+l.connected {
+		if queued == 0 {
+			l.queued++
+			queued = l.queued
+		}
+		changed, left := l.changed, time.Until(l.until)
+		l.mu.Unlock()
+		if left <= 0 {
+			l.release()
+		} else {
+			timer := time.NewTimer(left)
+			select {
+			case <-changed:
+			case <-timer.C:
+			}
+			timer.Stop()
+		}
+		l.mu.Lock()
+	}
+	if !l.released {
+		l.started++
+	}
+	l.mu.Unlock()
+	return queued
+}
+
+// workerConnected allows one more prewarm, or lifts the limit once all
+// size workers are connected; it is a no-op on a nil StartupLimiter
+func (l *StartupLimiter) workerConnected(connected, size int) {
+	if l == nil {
+		return
+	}
+	if connected >= size {
+		l.release()
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.connected = connected
+	l.notifyLocked()
+}
+
+// release lifts the limit
+func (l *StartupLimiter) release() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.released = true
+	l.notifyLocked()
+}
+
+// notifyLocked wakes the queued prewarms
+func (l *StartupLimiter) notifyLocked() {
+	close(l.changed)
+	l.changed = make(chan struct{})
+}
+
+// vim: noet:ts=4:sw=4:sts=4:spell
@@ -0,0 +1,121 @@
+/*
+ *  b4ck-client
+ *  Copyright 2020 Michał Trojnara
+
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU General Public License as published by
+ *  the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU General Public License for more details.
+
+ *  You should have received a copy of the GNU General Public License
+ *  along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// waitAsync runs l.wait in a goroutine, and returns its result channel
+func waitAsync(l *StartupLimiter) <-chan int {
+	result := make(chan int, 1)
+	go func() { result <- l.wait() }()
+	return result
+}
+
+// expectWait returns the result of waitAsync, and fails unless it
+// arrives within a second
+func expectWait(t *testing.T, result <-chan int) int {
+	t.Helper()
+	select {
+	case n := <-result:
+		return n
+	case <-time.After(time.Second):
+		t.Fatal("Prewarm still waiting after a second")
+	}
+	return 0
+}
+
+// expectBlocked checks that the result of waitAsync does not arrive yet
+func expectBlocked(t *testing.T, result <-chan int) {
+	t.Helper()
+	select {
+	case <-result:
+		t.Fatal("Prewarm started over the cap")
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestStartupLimiterRamp(t *testing.T) {
+	l := NewStartupLimiter(1, time.Hour)
+	if n := expectWait(t, waitAsync(l)); n != 0 {
+		t.Errorf("First prewarm queued as %d", n)
+	}
+
+	// Each connected worker allows one more prewarm
+	second := waitAsync(l)
+	expectBlocked(t, second)
+	l.workerConnected(1, 3)
+	if n := expectWait(t, second); n != 1 {
+		t.Errorf("Second prewarm queued as %d", n)
+	}
+
+	// The limit is lifted once all workers are connected
+	third, fourth := waitAsync(l), waitAsync(l)
+	expectBlocked(t, third)
+	expectBlocked(t, fourth)
+	l.workerConnected(3, 3)
+	if n := expectWait(t, third) + expectWait(t, fourth); n != 2+3 {
+		t.Errorf("Queued prewarms numbered %d in total", n)
+	}
+	if n := expectWait(t, waitAsync(l)); n != 0 {
+		t.Errorf("Prewarm after the startup queued as %d", n)
+	}
+}
+
+func TestStartupLimiterWindow(t *testing.T) {
+	l := NewStartupLimiter(1, 100*time.Millisecond)
+	expectWait(t, waitAsync(l))
+	if n := expectWait(t, waitAsync(l)); n != 1 {
+		t.Errorf("Prewarm queued as %d until the window elapsed", n)
+	}
+	if l.started != 1 {
+		t.Errorf("Started %d prewarms counted during the window", l.started)
+	}
+}
+
+func TestPoolRampsPrewarms(t *testing.T) {
+	// The ramp does not depend on the startup fill report
+	c := &Context{
+		logger:       GetLogger("test"),
+		prewarmLimit: NewStartupLimiter(1, time.Hour),
+	}
+	p := NewPool(c, 3, 3, 0)
+	p.ready = nil // No ready event
+	p.fillDone = true
+	p.connected(&Worker{id: 1})
+	p.connected(&Worker{id: 1})
+	if n := c.prewarmLimit.connected; n != 1 {
+		t.Errorf("Prewarm ramp at %d connected workers, expected 1", n)
+	}
+	p.connected(&Worker{id: 0})
+	p.connected(&Worker{id: 2})
+	if !c.prewarmLimit.released {
+		t.Error("Prewarm limit not lifted with all workers connected")
+	}
+}
+
+func TestStartupLimiterNil(t *testing.T) {
+	var l *StartupLimiter
+	expectWait(t, waitAsync(l))
+	l.workerConnected(1, 1)
+}
+
+// vim: noet:ts=4:sw=4:sts=4:spell
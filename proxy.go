@@ -20,28 +20,91 @@ package main
 
 import (
 	"crypto/tls"
+	"errors"
+	"fmt"
 	"io"
 	"net"
+	"runtime/debug"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
+// CloseOrder selects the copying direction Transfer waits for, see -close-order
+type CloseOrder int
+
+// Close orders
+const (
+	CloseSymmetric CloseOrder = iota
+	CloseLocalFirst
+	CloseRemoteFirst
+)
+
+var closeOrderNames = map[string]CloseOrder{
+	"symmetric":    CloseSymmetric,
+	"local-first":  CloseLocalFirst,
+	"remote-first": CloseRemoteFirst,
+}
+
+// ParseCloseOrder converts a close order name into a CloseOrder
+func ParseCloseOrder(name string) (CloseOrder, error) {
+	order, ok := closeOrderNames[name]
+	if !ok {
+		return CloseSymmetric, fmt.Errorf("unknown close order %q", name)
+	}
+	return order, nil
+}
+
 // Proxy object declaration
 type Proxy struct {
-	logger     *Logger
-	err        chan error
-	rcvd, sent int64
+	logger            *Logger
+	order             CloseOrder
+	closeWriteReset   bool
+	firstByte         time.Duration
+	readSizes         bool
+	failFast          bool   // Do not recover a panic while copying
+	class             string // "fast" or "slow", for logs
+	live              bool   // Track the directions while copying, see State
+	quota             *Quota // Counted while copying if live
+	toLocal, toRemote chan error
+	rcvd, sent        stream
+
+	mu       sync.Mutex // Orders the deadline changes of both directions
+	draining bool
+	aborted  bool
+}
+
+// stream is the state of a copying direction
+type stream struct {
+	bytes    int64 // Accessed atomically while copying
+	last     int64 // Unix nanoseconds of the last read, accessed atomically
+	sizes    ReadSizes
+	deadline time.Time // Last read deadline set, guarded by Proxy.mu
+}
+
+// ProxyState is a snapshot of the progress of a Proxy
+type ProxyState struct {
+	Sent, Received                 int64
+	LastSent, LastReceived         time.Time
+	SentDeadline, ReceivedDeadline time.Time // Zero if not set
+	Live                           bool      // Counts updated while copying
 }
 
 // GetProxy returns a new Proxy object
-func GetProxy(log *Logger) *Proxy {
+func GetProxy(log *Logger, order CloseOrder) *Proxy {
+	now := time.Now().UnixNano()
 	return &Proxy{
-		logger: log,
-		err:    make(chan error),
+		logger:   log,
+		order:    order,
+		toLocal:  make(chan error, 1),
+		toRemote: make(chan error, 1),
+		sent:     stream{last: now},
+		rcvd:     stream{last: now},
 	}
 }
 
 // Transfer forwards data between two Conn objects
-func (p *Proxy) Transfer(lconn net.Conn, rconn net.Conn) int64 {
+func (p *Proxy) Transfer(rconn net.Conn, lconn net.Conn) int64 {
 	// Disable the deadline with a zero value
 	var deadline time.Time
 	err := rconn.SetDeadline(deadline)
@@ -54,58 +117,283 @@ func (p *Proxy) Transfer(lconn net.Conn, rconn net.Conn) int64 {
 	}
 
 	p.logger.Debugf("Forwarding data")
-	go p.copy(rconn, lconn, &p.sent)
-	go p.copy(lconn, rconn, &p.rcvd)
+	go p.copy(lconn, rconn, &p.sent, p.toLocal)
+	go p.copy(rconn, lconn, &p.rcvd, p.toRemote)
 
 	// Wait for the 1st copying direction
-	err = <-p.err
+	var second chan error
+	switch p.order {
+	case CloseLocalFirst:
+		err, second = <-p.toRemote, p.toLocal
+	case CloseRemoteFirst:
+		err, second = <-p.toLocal, p.toRemote
+	default:
+		select {
+		case err = <-p.toLocal:
+			second = p.toRemote
+		case err = <-p.toRemote:
+			second = p.toLocal
+		}
+	}
 	if err == nil {
 		p.logger.Debugf("1st copying direction success")
 	} else {
 		p.logger.Warningf("1st copying direction failed: %s", err)
 	}
 
-	// Set a deadline for the 2nd copying direction
-	deadline = time.Now().Add(time.Minute)
-	err = rconn.SetDeadline(deadline)
-	if err != nil {
-		p.logger.Warningf("SetDeadline failed: %s", err)
+	// Check if both peers closed at the same time
+	done := false
+	select {
+	case err = <-second:
+		done = true
+		p.logger.Debugf("Both copying directions finished")
+	default:
 	}
-	err = lconn.SetDeadline(deadline)
-	if err != nil {
-		p.logger.Warningf("SetDeadline failed: %s", err)
+
+	// Set a deadline for the 2nd copying direction, unless it was aborted
+	// or is already done
+	p.mu.Lock()
+	p.draining = true
+	if !p.aborted && !done {
+		deadline = time.Now().Add(time.Minute)
+		err = rconn.SetDeadline(deadline)
+		if err != nil {
+			p.logger.Warningf("SetDeadline failed: %s", err)
+		}
+		err = lconn.SetDeadline(deadline)
+		if err != nil {
+			p.logger.Warningf("SetDeadline failed: %s", err)
+		}
+		p.sent.deadline, p.rcvd.deadline = deadline, deadline
 	}
+	p.mu.Unlock()
 
 	// Wait for the 2nd copying direction
-	err = <-p.err
+	if !done {
+		err = <-second
+	}
 	if err == nil {
 		p.logger.Debugf("2nd copying direction success")
 	} else {
 		p.logger.Warningf("2nd copying direction failed: %s", err)
 	}
 
-	p.logger.Infof("Closed: %d bytes sent, %d bytes recieved", p.sent, p.rcvd)
-	return p.sent + p.rcvd
+	p.logger.Infof("Closed: %d bytes sent, %d bytes recieved (%s)",
+		p.sent.bytes, p.rcvd.bytes, p.class)
+	if p.readSizes {
+		p.logger.Infof("Read sizes sent: %s", &p.sent.sizes)
+		p.logger.Infof("Read sizes received: %s", &p.rcvd.sizes)
+	}
+	return p.sent.bytes + p.rcvd.bytes
 }
 
-func (p *Proxy) copy(dst io.Writer, src io.Reader, bytes *int64) {
-	n, err := io.Copy(dst, src)
-	*bytes += n
+func (p *Proxy) copy(dst net.Conn, src net.Conn, s *stream, done chan<- error) {
+	defer p.recoverCopy(dst, src, done)
+	var r io.Reader = src
+	if p.firstByte > 0 {
+		r = &firstByteReader{p: p, s: s, conn: src}
+	}
+	if p.live {
+		r = &countingReader{r: r, s: s, quota: p.quota}
+	}
+	var n int64
+	var err error
+	if p.readSizes {
+		n, err = copyRecorded(dst, r, &s.sizes)
+	} else {
+		n, err = io.Copy(dst, r)
+	}
+	if !p.live {
+		atomic.AddInt64(&s.bytes, n)
+	}
 	if err == nil {
-		if conn, ok := dst.(*net.TCPConn); ok {
-			_ = conn.CloseWrite() // Send TCP FIN
-		} else if conn, ok := dst.(*tls.Conn); ok {
-			_ = conn.CloseWrite() // Send close_notify
+		err = closeWrite(dst)
+		if err == nil {
+			done <- nil
+			return
 		}
-	} else {
-		if conn, ok := dst.(*net.TCPConn); ok {
-			_ = conn.SetLinger(0) // Reset the dst socket
+		if !p.closeWriteReset {
+			p.logger.Warningf("CloseWrite failed: %s", err)
+			done <- nil
+			return
+		}
+		// Logged here, as Transfer may wait for the other direction first
+		p.logger.Warningf("CloseWrite failed, resetting both connections: %s", err)
+		err = &abortError{fmt.Errorf("CloseWrite failed: %w", err)}
+	}
+	reset(dst)
+	reset(src)
+	var abort *abortError
+	if errors.As(err, &abort) { // Possibly wrapped by ReadFrom
+		// Close the connections to abort the other direction
+		p.mu.Lock()
+		p.aborted = true
+		dst.Close()
+		src.Close()
+		p.mu.Unlock()
+	}
+	done <- err
+}
+
+// recoverCopy recovers a panic of a copying direction, and aborts both
+// directions, so that Transfer does not wait for the result forever
+func (p *Proxy) recoverCopy(dst net.Conn, src net.Conn, done chan<- error) {
+	if p.failFast {
+		return
+	}
+	r := recover()
+	if r == nil {
+		return
+	}
+	metricPanics.Inc()
+	p.logger.Errorf("Recovered from panic in proxy: %v\n%s", r, debug.Stack())
+	reset(dst)
+	reset(src)
+	p.mu.Lock()
+	p.aborted = true
+	dst.Close()
+	src.Close()
+	p.mu.Unlock()
+	done <- fmt.Errorf("panic: %v", r)
+}
+
+// Bytes returns the bytes sent and received
+func (p *Proxy) Bytes() (sent, rcvd int64) {
+	return atomic.LoadInt64(&p.sent.bytes), atomic.LoadInt64(&p.rcvd.bytes)
+}
+
+// State returns the progress of the transfer, updated while copying if live
+func (p *Proxy) State() ProxyState {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return ProxyState{
+		Sent:             atomic.LoadInt64(&p.sent.bytes),
+		Received:         atomic.LoadInt64(&p.rcvd.bytes),
+		LastSent:         time.Unix(0, atomic.LoadInt64(&p.sent.last)),
+		LastReceived:     time.Unix(0, atomic.LoadInt64(&p.rcvd.last)),
+		SentDeadline:     p.sent.deadline,
+		ReceivedDeadline: p.rcvd.deadline,
+		Live:             p.live,
+	}
+}
+
+// countingReader counts the bytes read as they are read, and aborts the
+// transfer once they exceed the quota
+type countingReader struct {
+	r     io.Reader
+	s     *stream
+	quota *Quota
+}
+
+func (c *countingReader) Read(b []byte) (int, error) {
+	n, err := c.r.Read(b)
+	if n > 0 {
+		atomic.AddInt64(&c.s.bytes, int64(n))
+		atomic.StoreInt64(&c.s.last, time.Now().UnixNano())
+		if !c.quota.use(n) {
+			err = &abortError{errQuota}
 		}
-		if conn, ok := src.(*net.TCPConn); ok {
-			_ = conn.SetLinger(0) // Reset the src socket
+	}
+	return n, err
+}
+
+// firstByteReader fails if the first byte does not arrive in time
+type firstByteReader struct {
+	p       *Proxy
+	s       *stream
+	conn    net.Conn
+	started bool
+}
+
+func (r *firstByteReader) Read(b []byte) (int, error) {
+	if r.started {
+		return r.conn.Read(b)
+	}
+	r.p.mu.Lock()
+	r.s.deadline = time.Now().Add(r.p.firstByte)
+	_ = r.conn.SetReadDeadline(r.s.deadline)
+	r.p.mu.Unlock()
+	n, err := r.conn.Read(b)
+	if n > 0 {
+		r.started = true
+		r.p.mu.Lock()
+		if !r.p.draining { // Keep the 2nd direction deadline
+			r.s.deadline = time.Time{}
+			_ = r.conn.SetReadDeadline(r.s.deadline)
 		}
+		r.p.mu.Unlock()
+	} else if isTimeout(err) {
+		err = &abortError{fmt.Errorf("no first byte within %s: %w", r.p.firstByte, err)}
+	}
+	return n, err
+}
+
+// abortError closes both connections instead of waiting for the other
+// copying direction
+type abortError struct {
+	error
+}
+
+// closeWrite half-closes the connection
+func closeWrite(dst io.Writer) error {
+	switch conn := dst.(type) {
+	case *net.TCPConn:
+		return conn.CloseWrite() // Send TCP FIN
+	case *tls.Conn:
+		return conn.CloseWrite() // Send close_notify
+	case *peekConn:
+		return closeWrite(conn.Conn)
+	case *faultConn:
+		return closeWrite(conn.Conn)
+	}
+	return nil
+}
+
+// reset makes closing a TCP connection send RST
+func reset(conn net.Conn) {
+	switch conn := conn.(type) {
+	case *net.TCPConn:
+		_ = conn.SetLinger(0)
+	case *peekConn:
+		reset(conn.Conn)
+	case *faultConn:
+		reset(conn.Conn)
+	}
+}
+
+// closeConn closes conn, or if timeout is set and closing takes longer,
+// e.g. sending a TLS close_notify, resets and closes the TCP connection
+func closeConn(conn net.Conn, timeout time.Duration) error {
+	if timeout <= 0 {
+		return conn.Close()
+	}
+	closed := make(chan error, 1)
+	go func() { closed <- conn.Close() }()
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case err := <-closed:
+		return err
+	case <-timer.C:
+	}
+	tcpConn := netConn(conn)
+	reset(tcpConn)
+	tcpConn.Close() // Fails the blocked Close
+	return fmt.Errorf("close not completed within %s", timeout)
+}
+
+// netConn returns the connection under the connection wrappers and TLS,
+// the latter only available with Go 1.18 or later
+func netConn(conn net.Conn) net.Conn {
+	switch c := conn.(type) {
+	case interface{ NetConn() net.Conn }: // *tls.Conn
+		return netConn(c.NetConn())
+	case *peekConn:
+		return netConn(c.Conn)
+	case *faultConn:
+		return netConn(c.Conn)
 	}
-	p.err <- err
+	return conn
 }
 
 // vim: noet:ts=4:sw=4:sts=4:spell
@@ -0,0 +1,216 @@
+/*
+ *  b4ck-client
+ *  Copyright 2020 Michał Trojnara
+
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU General Public License as published by
+ *  the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU General Public License for more details.
+
+ *  You should have received a copy of the GNU General Public License
+ *  along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"io"
+	"io/ioutil"
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// tcpPair returns both ends of a loopback TCP connection
+func tcpPair(t *testing.T) (net.Conn, net.Conn) {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	dialed, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	accepted, err := listener.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dialed, accepted
+}
+
+// eofDelayConn delays the end of its input, and records the deadlines set
+type eofDelayConn struct {
+	net.Conn
+	delay     time.Duration
+	mu        sync.Mutex
+	deadlines []time.Time
+}
+
+func (c *eofDelayConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	if err == io.EOF {
+		time.Sleep(c.delay)
+	}
+	return n, err
+}
+
+func (c *eofDelayConn) SetDeadline(t time.Time) error {
+	c.mu.Lock()
+	c.deadlines = append(c.deadlines, t)
+	c.mu.Unlock()
+	return c.Conn.SetDeadline(t)
+}
+
+func TestTransferSimultaneousClose(t *testing.T) {
+	server, rconn := tcpPair(t)
+	defer server.Close()
+	local, lconn := tcpPair(t)
+	defer local.Close()
+
+	// Both peers send their data and close at the same time; the remote
+	// end is reported last, so that the local end is already finished
+	r := &eofDelayConn{Conn: rconn, delay: 100 * time.Millisecond}
+	for _, peer := range []net.Conn{server, local} {
+		_, err := peer.Write([]byte("data"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = peer.(*net.TCPConn).CloseWrite()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	p := GetProxy(GetLogger("test"), CloseRemoteFirst)
+	start := time.Now()
+	p.Transfer(r, lconn)
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("Transfer took %s", elapsed)
+	}
+	if sent, rcvd := p.Bytes(); sent != 4 || rcvd != 4 {
+		t.Errorf("Transferred %d bytes sent, %d bytes received, expected 4 and 4", sent, rcvd)
+	}
+	for _, deadline := range r.deadlines {
+		if !deadline.IsZero() {
+			t.Errorf("Drain deadline set on finished connections: %s", deadline)
+		}
+	}
+
+	// The local peer receives the data and the end of input
+	_ = local.SetReadDeadline(time.Now().Add(5 * time.Second))
+	data, err := ioutil.ReadAll(local)
+	if err != nil || string(data) != "data" {
+		t.Errorf("Local peer received %q: %v", data, err)
+	}
+}
+
+// panicConn panics on reads
+type panicConn struct {
+	net.Conn
+}
+
+func (c *panicConn) Read(b []byte) (int, error) {
+	panic("test panic")
+}
+
+func TestTransferPanic(t *testing.T) {
+	server, rconn := tcpPair(t)
+	defer server.Close()
+	local, lconn := tcpPair(t)
+	defer local.Close()
+
+	// The local peer stays open, so only the recovery of the panicking
+	// direction can end the transfer
+	p := GetProxy(GetLogger("test"), CloseLocalFirst)
+	before := metricPanics.Value()
+	finished := make(chan struct{})
+	go func() {
+		p.Transfer(&panicConn{rconn}, lconn)
+		close(finished)
+	}()
+	select {
+	case <-finished:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Transfer blocked after a panic")
+	}
+	if n := metricPanics.Value() - before; n != 1 {
+		t.Errorf("Panic counted %d times", n)
+	}
+}
+
+func TestTransferQuota(t *testing.T) {
+	server, rconn := tcpPair(t)
+	defer server.Close()
+	local, lconn := tcpPair(t)
+	defer local.Close()
+
+	// Neither peer closes, so only the quota can end the transfer
+	_, err := server.Write(make([]byte, 100))
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := GetProxy(GetLogger("test"), CloseSymmetric)
+	p.quota = NewQuota(10)
+	p.live = true
+	finished := make(chan struct{})
+	go func() {
+		p.Transfer(rconn, lconn)
+		close(finished)
+	}()
+	select {
+	case <-finished:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Transfer not stopped by the quota")
+	}
+	if n := p.quota.Remaining(); n != 0 {
+		t.Errorf("Quota has %d bytes remaining", n)
+	}
+}
+
+// slowCloseConn blocks its first Close until the connection is closed
+type slowCloseConn struct {
+	net.Conn
+	closes int32
+}
+
+func (c *slowCloseConn) NetConn() net.Conn {
+	return c.Conn
+}
+
+func (c *slowCloseConn) Close() error {
+	if atomic.AddInt32(&c.closes, 1) == 1 {
+		_, _ = c.Conn.Read(make([]byte, 1)) // Returns once closed
+	}
+	return nil
+}
+
+func TestCloseConnTimeout(t *testing.T) {
+	peer, conn := tcpPair(t)
+	defer peer.Close()
+
+	c := &slowCloseConn{Conn: conn}
+	start := time.Now()
+	if err := closeConn(c, 100*time.Millisecond); err == nil {
+		t.Error("Blocked close reported success")
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("Close took %s", elapsed)
+	}
+
+	// The connection is reset rather than closed cleanly
+	_ = peer.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := peer.Read(make([]byte, 1)); err == nil || err == io.EOF {
+		t.Errorf("Peer read after the timeout returned %v, expected a reset", err)
+	}
+}
+
+// vim: noet:ts=4:sw=4:sts=4:spell
@@ -0,0 +1,58 @@
+/*
+ *  b4ck-client
+ *  Copyright 2020 Michał Trojnara
+
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU General Public License as published by
+ *  the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU General Public License for more details.
+
+ *  You should have received a copy of the GNU General Public License
+ *  along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"errors"
+	"sync/atomic"
+)
+
+// errQuota aborts the connections forwarding data over the transfer quota
+var errQuota = errors.New("transfer quota exceeded")
+
+// Quota counts the bytes forwarded by all connections against a limit
+type Quota struct {
+	limit uint64
+	used  uint64 // Accessed atomically
+}
+
+// NewQuota returns a new Quota of limit bytes
+func NewQuota(limit uint64) *Quota {
+	return &Quota{limit: limit}
+}
+
+// use counts n forwarded bytes, and reports false once the quota is
+// exceeded; it always reports true on a nil Quota
+func (q *Quota) use(n int) bool {
+	if q == nil {
+		return true
+	}
+	return atomic.AddUint64(&q.used, uint64(n)) <= q.limit
+}
+
+// Remaining returns the number of bytes left in the quota
+func (q *Quota) Remaining() uint64 {
+	used := atomic.LoadUint64(&q.used)
+	if used >= q.limit {
+		return 0
+	}
+	return q.limit - used
+}
+
+// vim: noet:ts=4:sw=4:sts=4:spell
@@ -0,0 +1,91 @@
+/*
+ *  b4ck-client
+ *  Copyright 2020 Michał Trojnara
+
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU General Public License as published by
+ *  the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU General Public License for more details.
+
+ *  You should have received a copy of the GNU General Public License
+ *  along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"strings"
+)
+
+// readSizeBuckets are the upper bounds of the cumulative read size
+// histogram; the last bucket counts all reads into the 32 KiB buffer
+var readSizeBuckets = [...]int{64, 512, 4096, 16384, 32768}
+
+var metricReadSizes = func() []*Counter {
+	counters := make([]*Counter, len(readSizeBuckets))
+	for i, limit := range readSizeBuckets {
+		counters[i] = metrics.NewCounter(
+			fmt.Sprintf("b4ck_reads_le_%d_bytes_total", limit),
+			fmt.Sprintf("Forwarded reads of at most %d bytes, with -read-sizes", limit))
+	}
+	return counters
+}()
+
+// ReadSizes is a cumulative histogram of the read sizes of a copying
+// direction, each bucket counting the reads of at most its bound
+type ReadSizes struct {
+	counts [len(readSizeBuckets)]uint64
+}
+
+// record counts a read of n bytes
+func (h *ReadSizes) record(n int) {
+	for i, limit := range readSizeBuckets {
+		if n <= limit {
+			h.counts[i]++
+			metricReadSizes[i].Inc()
+		}
+	}
+}
+
+func (h *ReadSizes) String() string {
+	t := make([]string, len(readSizeBuckets))
+	for i, limit := range readSizeBuckets {
+		t[i] = fmt.Sprintf("<=%d:%d", limit, h.counts[i])
+	}
+	return strings.Join(t, " ")
+}
+
+// copyRecorded is io.Copy with a 32 KiB buffer that records read sizes
+func copyRecorded(dst io.Writer, src io.Reader, sizes *ReadSizes) (int64, error) {
+	buf := make([]byte, 32*1024)
+	var written int64
+	for {
+		nr, er := src.Read(buf)
+		if nr > 0 {
+			sizes.record(nr)
+			nw, ew := dst.Write(buf[:nr])
+			written += int64(nw)
+			if ew != nil {
+				return written, ew
+			}
+			if nw != nr {
+				return written, io.ErrShortWrite
+			}
+		}
+		if er == io.EOF {
+			return written, nil
+		}
+		if er != nil {
+			return written, er
+		}
+	}
+}
+
+// vim: noet:ts=4:sw=4:sts=4:spell
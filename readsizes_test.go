@@ -0,0 +1,49 @@
+/*
+ *  b4ck-client
+ *  Copyright 2020 Michał Trojnara
+
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU General Public License as published by
+ *  the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU General Public License for more details.
+
+ *  You should have received a copy of the GNU General Public License
+ *  along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"testing"
+)
+
+func TestReadSizesCumulative(t *testing.T) {
+	var h ReadSizes
+	before := make([]uint64, len(metricReadSizes))
+	for i, counter := range metricReadSizes {
+		before[i] = counter.Value()
+	}
+	for _, n := range []int{1, 64, 65, 4096, 32768} {
+		h.record(n)
+	}
+	expected := [len(readSizeBuckets)]uint64{2, 3, 4, 4, 5}
+	if h.counts != expected {
+		t.Errorf("Read sizes %v, expected %v", h.counts, expected)
+	}
+	for i, counter := range metricReadSizes {
+		if n := counter.Value() - before[i]; n != expected[i] {
+			t.Errorf("Counter of reads <= %d bytes increased by %d, expected %d",
+				readSizeBuckets[i], n, expected[i])
+		}
+	}
+	if s := h.String(); s != "<=64:2 <=512:3 <=4096:4 <=16384:4 <=32768:5" {
+		t.Errorf("Read sizes formatted as %q", s)
+	}
+}
+
+// vim: noet:ts=4:sw=4:sts=4:spell
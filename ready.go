@@ -0,0 +1,98 @@
+/*
+ *  b4ck-client
+ *  Copyright 2020 Michał Trojnara
+
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU General Public License as published by
+ *  the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU General Public License for more details.
+
+ *  You should have received a copy of the GNU General Public License
+ *  along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+// Readiness is the set of conditions required to report ready
+type Readiness int
+
+// Readiness components
+const (
+	ReadyControl Readiness = 1 << iota // Control connections wait for work
+	ReadyBackend                       // The local service is reachable
+)
+
+var readinessNames = map[string]Readiness{
+	"control": ReadyControl,
+	"backend": ReadyBackend,
+	"both":    ReadyControl | ReadyBackend,
+}
+
+// readyCheckInterval is the interval of the local service tests for
+// readiness
+const readyCheckInterval = 5 * time.Second
+
+// ParseReadiness converts a readiness name into a Readiness
+func ParseReadiness(name string) (Readiness, error) {
+	r, ok := readinessNames[name]
+	if !ok {
+		return ReadyControl, fmt.Errorf("unknown readiness %q", name)
+	}
+	return r, nil
+}
+
+// isReady reports whether all the readiness components are met
+func (c *Context) isReady() bool {
+	if c.readiness&ReadyControl != 0 && metricReady.Value() == 0 {
+		return false
+	}
+	if c.readiness&ReadyBackend != 0 && !c.backendReachable() {
+		return false
+	}
+	return true
+}
+
+// backendReachable reports the last known health of the local service,
+// updated by probeBackend and by the forwarded connections
+func (c *Context) backendReachable() bool {
+	status := c.backend.Status()
+	return !status.LastDial.IsZero() && status.Healthy
+}
+
+// probeBackend tests the local service every readyCheckInterval, so that
+// readiness never waits for a dial
+func (c *Context) probeBackend() {
+	defer c.guard(c.logger, "backend probe", nil)
+	for {
+		if time.Since(c.backend.Status().LastDial) >= readyCheckInterval {
+			_ = c.checkBackend()
+		}
+		time.Sleep(readyCheckInterval)
+	}
+}
+
+// waitBackend blocks until the local service is reachable, if readiness
+// requires it
+func (c *Context) waitBackend() {
+	if c.readiness&ReadyBackend == 0 {
+		return
+	}
+	for i := 0; !c.backendReachable(); i++ {
+		if i == 0 {
+			c.logger.Warningf("Not ready: local service %s is unreachable", c.laddr)
+		}
+		time.Sleep(time.Second)
+	}
+}
+
+// vim: noet:ts=4:sw=4:sts=4:spell
@@ -0,0 +1,167 @@
+/*
+ *  b4ck-client
+ *  Copyright 2020 Michał Trojnara
+
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU General Public License as published by
+ *  the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU General Public License for more details.
+
+ *  You should have received a copy of the GNU General Public License
+ *  along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"sync/atomic"
+	"time"
+)
+
+var metricRecordsDropped = metrics.NewCounter("b4ck_records_dropped_total",
+	"Connection records dropped because the record queue was full")
+
+// ConnRecord describes a completed connection
+type ConnRecord struct {
+	ID       uint64    `json:"id"`
+	Start    time.Time `json:"start"`
+	End      time.Time `json:"end"`
+	Addr     string    `json:"addr"`
+	Backend  string    `json:"backend"`
+	Dialed   string    `json:"dialed,omitempty"`
+	Class    string    `json:"class"` // "fast" or "slow", as flagged by the server
+	Sent     int64     `json:"bytes_sent"`
+	Received int64     `json:"bytes_received"`
+	Reason   string    `json:"reason"` // "closed", or why it was not forwarded
+}
+
+// RecordLog appends connection records to a JSON lines file, rotated to
+// path.1 ... path.keep when it exceeds maxSize bytes.  Records are written
+// by a single goroutine, and dropped rather than blocking the caller when
+// the queue is full.
+type RecordLog struct {
+	pending int64 // Queued records, accessed atomically
+	logger  *Logger
+	path    string
+	maxSize int64
+	keep    int
+	records chan *ConnRecord
+	file    *os.File
+	size    int64
+}
+
+// NewRecordLog opens the record file at path
+func NewRecordLog(logger *Logger, path string, maxSize int64, keep, depth int) (*RecordLog, error) {
+	err := checkWritable(path)
+	if err != nil {
+		return nil, err
+	}
+	l := &RecordLog{
+		logger:  logger,
+		path:    path,
+		maxSize: maxSize,
+		keep:    keep,
+		records: make(chan *ConnRecord, depth),
+	}
+	err = l.open()
+	if err != nil {
+		return nil, err
+	}
+	go l.run()
+	return l, nil
+}
+
+// Add queues a record; it is a no-op on a nil RecordLog
+func (l *RecordLog) Add(r *ConnRecord) {
+	if l == nil {
+		return
+	}
+	atomic.AddInt64(&l.pending, 1)
+	select {
+	case l.records <- r:
+	default:
+		atomic.AddInt64(&l.pending, -1)
+		metricRecordsDropped.Inc()
+	}
+}
+
+// Flush waits until the queued records are written or the deadline passes,
+// and returns the number of records left; it is a no-op on a nil RecordLog
+func (l *RecordLog) Flush(deadline time.Time) int {
+	if l == nil {
+		return 0
+	}
+	return waitPending(&l.pending, deadline)
+}
+
+func (l *RecordLog) open() error {
+	file, err := os.OpenFile(l.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	l.file, l.size = file, info.Size()
+	return nil
+}
+
+func (l *RecordLog) run() {
+	for r := range l.records {
+		l.write(r)
+		atomic.AddInt64(&l.pending, -1)
+	}
+}
+
+func (l *RecordLog) write(r *ConnRecord) {
+	line, err := json.Marshal(r)
+	if err != nil {
+		l.logger.Warningf("Failed to serialize connection record: %s", err)
+		return
+	}
+	if l.file == nil { // Reopening after a rotation failed
+		metricRecordsDropped.Inc()
+		return
+	}
+	n, err := l.file.Write(append(line, '\n'))
+	l.size += int64(n)
+	if err != nil {
+		l.logger.Warningf("Failed to write connection record: %s", err)
+	}
+	if l.maxSize > 0 && l.size >= l.maxSize {
+		err = l.rotate()
+		if err != nil {
+			l.logger.Warningf("Failed to rotate connection records: %s", err)
+		}
+	}
+}
+
+// rotate renames path.N to path.N+1, dropping path.keep, and path to path.1
+func (l *RecordLog) rotate() error {
+	l.file.Close()
+	l.file = nil
+	for i := l.keep - 1; i > 0; i-- {
+		_ = os.Rename(fmt.Sprintf("%s.%d", l.path, i), fmt.Sprintf("%s.%d", l.path, i+1))
+	}
+	var err error
+	if l.keep > 0 {
+		err = os.Rename(l.path, l.path+".1")
+	} else {
+		err = os.Remove(l.path)
+	}
+	if e := l.open(); e != nil { // Keep appending if renaming failed
+		return e
+	}
+	return err
+}
+
+// vim: noet:ts=4:sw=4:sts=4:spell
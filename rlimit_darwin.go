@@ -0,0 +1,40 @@
+//go:build darwin
+// +build darwin
+
+/*
+ *  b4ck-client
+ *  Copyright 2020 Michał Trojnara
+
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU General Public License as published by
+ *  the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU General Public License for more details.
+
+ *  You should have received a copy of the GNU General Public License
+ *  along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"syscall"
+)
+
+// raisedFileLimit returns limit with the soft limit raised to the hard
+// limit, capped at kern.maxfilesperproc, as darwin rejects a higher soft
+// limit, e.g. with an RLIM_INFINITY hard limit
+func raisedFileLimit(limit syscall.Rlimit) syscall.Rlimit {
+	limit.Cur = limit.Max
+	max, err := syscall.SysctlUint32("kern.maxfilesperproc")
+	if err == nil && limit.Cur > uint64(max) {
+		limit.Cur = uint64(max)
+	}
+	return limit
+}
+
+// vim: noet:ts=4:sw=4:sts=4:spell
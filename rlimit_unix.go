@@ -0,0 +1,49 @@
+//go:build darwin || dragonfly || freebsd || linux || netbsd || openbsd
+// +build darwin dragonfly freebsd linux netbsd openbsd
+
+/*
+ *  b4ck-client
+ *  Copyright 2020 Michał Trojnara
+
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU General Public License as published by
+ *  the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU General Public License for more details.
+
+ *  You should have received a copy of the GNU General Public License
+ *  along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"syscall"
+)
+
+// raiseFileLimit raises the soft limit of open files to the hard limit
+func raiseFileLimit(logger *Logger) {
+	var limit syscall.Rlimit
+	err := syscall.Getrlimit(syscall.RLIMIT_NOFILE, &limit)
+	if err != nil {
+		logger.Warningf("Failed to read the open file limit: %s", err)
+		return
+	}
+	raised := raisedFileLimit(limit)
+	if raised.Cur <= limit.Cur {
+		logger.Infof("Open file limit: %d", limit.Cur)
+		return
+	}
+	err = syscall.Setrlimit(syscall.RLIMIT_NOFILE, &raised)
+	if err != nil {
+		logger.Warningf("Failed to raise the open file limit from %d: %s", limit.Cur, err)
+		return
+	}
+	logger.Infof("Open file limit raised from %d to %d", limit.Cur, raised.Cur)
+}
+
+// vim: noet:ts=4:sw=4:sts=4:spell
@@ -0,0 +1,332 @@
+/*
+ *  b4ck-client
+ *  Copyright 2020 Michał Trojnara
+
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU General Public License as published by
+ *  the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU General Public License for more details.
+
+ *  You should have received a copy of the GNU General Public License
+ *  along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Detected protocols
+const (
+	ProtoHTTP = "http"
+	ProtoTLS  = "tls"
+	ProtoSSH  = "ssh"
+)
+
+// maxPeek limits the client data buffered for protocol detection; it fits
+// a TLS record header and the largest TLS record
+const maxPeek = 5 + 16384
+
+var httpMethods = []string{
+	"GET ", "HEAD ", "POST ", "PUT ", "DELETE ",
+	"CONNECT ", "OPTIONS ", "TRACE ", "PATCH ",
+}
+
+// Routes selects a backend by the protocol of the first client bytes
+type Routes struct {
+	backends map[string]string   // Keyed by protocol or "sni:" + server name
+	health   map[string]*Backend // Keyed by backend address
+}
+
+// ParseRoutes parses a comma-separated list of "protocol=address" or
+// "sni:name=address" entries
+func ParseRoutes(s string) (*Routes, error) {
+	r := &Routes{
+		backends: make(map[string]string),
+		health:   make(map[string]*Backend),
+	}
+	for _, entry := range strings.Split(s, ",") {
+		t := strings.SplitN(strings.TrimSpace(entry), "=", 2)
+		if len(t) != 2 || t[1] == "" {
+			return nil, fmt.Errorf("invalid route: %s", entry)
+		}
+		key := strings.ToLower(t[0])
+		switch {
+		case key == ProtoHTTP, key == ProtoTLS, key == ProtoSSH:
+		case strings.HasPrefix(key, "sni:") && len(key) > 4:
+		default:
+			return nil, fmt.Errorf("unknown protocol in route: %s", entry)
+		}
+		if _, _, err := net.SplitHostPort(t[1]); err != nil {
+			return nil, fmt.Errorf("invalid route: %w", err)
+		}
+		r.backends[key] = t[1]
+		if r.health[t[1]] == nil {
+			r.health[t[1]] = NewBackend(t[1])
+		}
+	}
+	return r, nil
+}
+
+// lookup returns the backend for the detected protocol and server name,
+// or an empty string if none is configured
+func (r *Routes) lookup(proto, sni string) string {
+	if sni != "" {
+		if addr, ok := r.backends["sni:"+strings.ToLower(sni)]; ok {
+			return addr
+		}
+	}
+	return r.backends[proto]
+}
+
+// statuses returns the health of the routed backends sorted by address
+func (r *Routes) statuses() []BackendStatus {
+	addrs := make([]string, 0, len(r.health))
+	for addr := range r.health {
+		addrs = append(addrs, addr)
+	}
+	sort.Strings(addrs)
+	statuses := make([]BackendStatus, 0, len(addrs))
+	for _, addr := range addrs {
+		statuses = append(statuses, r.health[addr].Status())
+	}
+	return statuses
+}
+
+// ParseServerNames parses a comma-separated list of "client=backend"
+// server name mappings
+func ParseServerNames(s string) (map[string]string, error) {
+	names := make(map[string]string)
+	for _, entry := range strings.Split(s, ",") {
+		t := strings.SplitN(strings.TrimSpace(entry), "=", 2)
+		if len(t) != 2 || t[0] == "" || t[1] == "" {
+			return nil, fmt.Errorf("invalid server name mapping: %s", entry)
+		}
+		names[strings.ToLower(t[0])] = t[1]
+	}
+	return names, nil
+}
+
+// backendFor returns the health tracker of the local service at addr
+func (c *Context) backendFor(addr string) *Backend {
+	if addr != c.laddr && c.routes != nil {
+		if b, ok := c.routes.health[addr]; ok {
+			return b
+		}
+	}
+	return c.backend
+}
+
+// route peeks at the first client bytes to select the backend, or addr if
+// none matches, and returns a connection replaying the peeked bytes, the
+// backend and the TLS SNI of the client
+func (c *Context) route(logger *Logger, rconn net.Conn, addr string) (net.Conn, string, string) {
+	data, err := peek(rconn, c.routeTimeout)
+	if err != nil {
+		logger.Debugf("Protocol detection stopped: %s", err)
+	}
+	proto, sni := detectProtocol(data)
+	if backend := c.routes.lookup(proto, sni); backend != "" {
+		addr = backend
+	}
+	switch {
+	case sni != "":
+		logger.Infof("Detected %s with SNI %s, routing to %s", proto, sni, addr)
+	case proto != "":
+		logger.Infof("Detected %s, routing to %s", proto, addr)
+	default:
+		logger.Infof("Unknown protocol, routing to %s", addr)
+	}
+	return &peekConn{Conn: rconn, buf: data}, addr, sni
+}
+
+// serverNameFor selects the local TLS server name for the backend at addr
+// and the client TLS SNI: mapped, forwarded, the default, or the host of addr
+func (c *Context) serverNameFor(addr, sni string) string {
+	if sni != "" {
+		if name, ok := c.localTLSNames[strings.ToLower(sni)]; ok {
+			return name
+		}
+		if c.localTLSForwardSNI {
+			return sni
+		}
+	}
+	if c.localTLSName != "" {
+		return c.localTLSName
+	}
+	host, _, _ := net.SplitHostPort(addr)
+	if host == "" {
+		host = "localhost"
+	}
+	return host
+}
+
+// peek reads the first client bytes until a protocol can be detected,
+// maxPeek bytes are buffered, or the timeout expires
+func peek(conn net.Conn, timeout time.Duration) ([]byte, error) {
+	err := conn.SetReadDeadline(time.Now().Add(timeout))
+	if err != nil {
+		return nil, err
+	}
+	defer conn.SetReadDeadline(time.Time{})
+	buf := make([]byte, maxPeek)
+	n := 0
+	for n < len(buf) {
+		var m int
+		m, err = conn.Read(buf[n:])
+		n += m
+		if err != nil || !needMore(buf[:n]) {
+			break
+		}
+	}
+	return buf[:n], err
+}
+
+// needMore reports whether data is too short to detect the protocol
+func needMore(data []byte) bool {
+	if len(data) < 5 {
+		return true
+	}
+	if data[0] == 0x16 { // A TLS record with the complete ClientHello
+		return len(data) < 5+int(binary.BigEndian.Uint16(data[3:5]))
+	}
+	return false
+}
+
+// detectProtocol identifies the protocol of the first client bytes, and
+// returns the server name of a TLS ClientHello
+func detectProtocol(data []byte) (proto, sni string) {
+	switch {
+	case len(data) >= 3 && data[0] == 0x16 && data[1] == 0x03:
+		return ProtoTLS, clientHelloSNI(data)
+	case bytes.HasPrefix(data, []byte("SSH-")):
+		return ProtoSSH, ""
+	}
+	for _, method := range httpMethods {
+		if bytes.HasPrefix(data, []byte(method)) {
+			return ProtoHTTP, ""
+		}
+	}
+	return "", ""
+}
+
+// clientHelloSNI extracts the server_name extension from a TLS record
+// containing a ClientHello, or returns an empty string
+func clientHelloSNI(data []byte) string {
+	// Record header, handshake header, version, and random
+	p := &tlsParser{data: data}
+	if !p.skip(5) || !p.expect(0x01) || !p.skip(3+2+32) {
+		return ""
+	}
+	// Session id, cipher suites, and compression methods
+	if !p.skipVector(1) || !p.skipVector(2) || !p.skipVector(1) {
+		return ""
+	}
+	ext, ok := p.vector(2)
+	if !ok {
+		return ""
+	}
+	for len(ext.data) >= 4 {
+		typ, _ := ext.uint(2)
+		body, ok := ext.vector(2)
+		if !ok {
+			return ""
+		}
+		if typ == 0 { // server_name
+			return serverName(body)
+		}
+	}
+	return ""
+}
+
+// serverName returns the host_name entry of a server_name extension
+func serverName(body *tlsParser) string {
+	list, ok := body.vector(2)
+	if !ok {
+		return ""
+	}
+	for len(list.data) >= 3 {
+		nameType, _ := list.uint(1)
+		name, ok := list.vector(2)
+		if !ok {
+			return ""
+		}
+		if nameType == 0 { // host_name
+			return string(name.data)
+		}
+	}
+	return ""
+}
+
+// tlsParser reads big-endian integers and length-prefixed vectors
+type tlsParser struct {
+	data []byte
+}
+
+func (p *tlsParser) skip(n int) bool {
+	if len(p.data) < n {
+		return false
+	}
+	p.data = p.data[n:]
+	return true
+}
+
+func (p *tlsParser) expect(b byte) bool {
+	return len(p.data) > 0 && p.data[0] == b && p.skip(1)
+}
+
+func (p *tlsParser) uint(size int) (int, bool) {
+	if len(p.data) < size {
+		return 0, false
+	}
+	v := 0
+	for _, b := range p.data[:size] {
+		v = v<<8 | int(b)
+	}
+	p.data = p.data[size:]
+	return v, true
+}
+
+func (p *tlsParser) vector(size int) (*tlsParser, bool) {
+	n, ok := p.uint(size)
+	if !ok || len(p.data) < n {
+		return nil, false
+	}
+	v := &tlsParser{data: p.data[:n]}
+	p.data = p.data[n:]
+	return v, true
+}
+
+func (p *tlsParser) skipVector(size int) bool {
+	_, ok := p.vector(size)
+	return ok
+}
+
+// peekConn replays the bytes consumed by protocol detection
+type peekConn struct {
+	net.Conn
+	buf []byte
+}
+
+func (c *peekConn) Read(b []byte) (int, error) {
+	if len(c.buf) > 0 {
+		n := copy(b, c.buf)
+		c.buf = c.buf[n:]
+		return n, nil
+	}
+	return c.Conn.Read(b)
+}
+
+// vim: noet:ts=4:sw=4:sts=4:spell
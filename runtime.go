@@ -0,0 +1,95 @@
+/*
+ *  b4ck-client
+ *  Copyright 2020 Michał Trojnara
+
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU General Public License as published by
+ *  the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU General Public License for more details.
+
+ *  You should have received a copy of the GNU General Public License
+ *  along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"io/ioutil"
+	"runtime"
+	"sync"
+	"time"
+)
+
+// memStatsCache limits ReadMemStats calls to one per scrape
+type memStatsCache struct {
+	mu    sync.Mutex
+	read  time.Time
+	stats runtime.MemStats
+}
+
+func (m *memStatsCache) get() *runtime.MemStats {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if time.Since(m.read) > time.Second {
+		runtime.ReadMemStats(&m.stats)
+		m.read = time.Now()
+	}
+	return &m.stats
+}
+
+// registerRuntimeMetrics exports Go runtime and process resource usage
+func registerRuntimeMetrics() {
+	mem := &memStatsCache{}
+	metrics.NewGaugeFunc("b4ck_goroutines", "Number of goroutines", func() float64 {
+		return float64(runtime.NumGoroutine())
+	})
+	metrics.NewGaugeFunc("b4ck_memory_heap_bytes", "Bytes of allocated heap objects", func() float64 {
+		return float64(mem.get().HeapAlloc)
+	})
+	metrics.NewGaugeFunc("b4ck_memory_sys_bytes", "Bytes of memory obtained from the OS", func() float64 {
+		return float64(mem.get().Sys)
+	})
+	metrics.NewGaugeFunc("b4ck_gc_cycles", "Completed GC cycles", func() float64 {
+		return float64(mem.get().NumGC)
+	})
+	if _, err := ioutil.ReadDir("/proc/self/fd"); err == nil {
+		metrics.NewGaugeFunc("b4ck_open_fds", "Open file descriptors", func() float64 {
+			fds, err := ioutil.ReadDir("/proc/self/fd")
+			if err != nil {
+				return 0
+			}
+			return float64(len(fds))
+		})
+	}
+}
+
+// monitorGoroutines logs the goroutine count every interval at DEBUG, and
+// warns when it stays over threshold above the lowest count observed for
+// three consecutive checks
+func monitorGoroutines(logger *Logger, interval time.Duration, threshold int) {
+	lowest := runtime.NumGoroutine()
+	streak := 0
+	for range time.Tick(interval) {
+		n := runtime.NumGoroutine()
+		logger.Debugf("Goroutines: %d", n)
+		if n < lowest {
+			lowest = n
+		}
+		if n-lowest <= threshold {
+			streak = 0
+			continue
+		}
+		streak++
+		if streak == 3 {
+			logger.Warningf("Possible goroutine leak: %d goroutines, %d above the lowest count",
+				n, n-lowest)
+		}
+	}
+}
+
+// vim: noet:ts=4:sw=4:sts=4:spell
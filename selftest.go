@@ -0,0 +1,128 @@
+/*
+ *  b4ck-client
+ *  Copyright 2020 Michał Trojnara
+
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU General Public License as published by
+ *  the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU General Public License for more details.
+
+ *  You should have received a copy of the GNU General Public License
+ *  along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"reflect"
+	"strings"
+)
+
+// selfTest verifies that representative messages survive the framing
+func selfTest(logger *Logger) bool {
+	messages, err := representativeMessages()
+	if err != nil {
+		logger.Errorf("Failed to serialize: %s", err)
+		return false
+	}
+	maxMsg := messages[len(messages)-1]
+
+	ok := true
+	for _, sent := range messages {
+		var buf bytes.Buffer
+		err := SndMsg(&buf, sent)
+		if err != nil {
+			logger.Errorf("%s: failed to send: %s", sent.Type, err)
+			ok = false
+			continue
+		}
+		rcvd, err := RcvMsg(&buf)
+		if err != nil {
+			logger.Errorf("%s: failed to receive: %s", sent.Type, err)
+			ok = false
+			continue
+		}
+		if buf.Len() != 0 {
+			logger.Errorf("%s: %d trailing bytes", sent.Type, buf.Len())
+			ok = false
+		}
+		for _, diff := range diffMsg(sent, rcvd) {
+			logger.Errorf("%s: %s", sent.Type, diff)
+			ok = false
+		}
+	}
+
+	// Messages exceeding the length prefix must be rejected
+	tooLong := &Msg{Type: "info", Text: maxMsg.Text + "x"}
+	if SndMsg(&bytes.Buffer{}, tooLong) == nil {
+		logger.Errorf("Oversized message was not rejected")
+		ok = false
+	}
+
+	if ok {
+		logger.Infof("Self-test passed: %d messages", len(messages))
+	}
+	return ok
+}
+
+// representativeMessages returns messages covering every field, special
+// characters, and the maximum length as the last message
+func representativeMessages() ([]*Msg, error) {
+	// Pad Text so that the serialized message has exactly MaxMsgLen bytes
+	maxMsg := &Msg{Type: "info", Text: "x"}
+	serialized, err := json.Marshal(maxMsg)
+	if err != nil {
+		return nil, err
+	}
+	maxMsg.Text = strings.Repeat("x", MaxMsgLen-len(serialized)+1)
+
+	return []*Msg{
+		{Type: "listen", Port: 80, Key: []byte{0x00, 0xff, 0x7f, 0x80, 0x0a, 0x22}},
+		{Type: "challenge", Nonce: []byte{0x00, 0xff, 0x7f, 0x80, 0x0a, 0x22, 0x5c, 0x2f}},
+		{Type: "listen", Port: 80, Auth: AuthHMAC, Key: bytes.Repeat([]byte{0xa5}, 32)},
+		{Type: "start", Fast: true, Addr: "[2001:db8::1]:65535"},
+		{Type: "start", Addr: "192.0.2.1:1024"},
+		{Type: "keepalive"},
+		{Type: "pool", Workers: 8},
+		{Type: "info", Text: ""},
+		{Type: "info", Text: "\"quoted\" \\ \n\t\x00 zażółć \U0001F600"},
+		{Type: "info", Text: "TIMEOUT", Reason: ReasonQuota},
+		maxMsg,
+	}, nil
+}
+
+// diffMsg lists the fields that differ between two messages
+func diffMsg(a, b *Msg) []string {
+	var diffs []string
+	va, vb := reflect.ValueOf(*a), reflect.ValueOf(*b)
+	for i := 0; i < va.NumField(); i++ {
+		fa, fb := va.Field(i).Interface(), vb.Field(i).Interface()
+		if ka, ok := fa.([]byte); ok { // nil and empty keys are equivalent
+			if bytes.Equal(ka, fb.([]byte)) {
+				continue
+			}
+		} else if reflect.DeepEqual(fa, fb) {
+			continue
+		}
+		diffs = append(diffs, fmt.Sprintf("%s: sent %s, received %s",
+			va.Type().Field(i).Name, sprintValue(fa), sprintValue(fb)))
+	}
+	return diffs
+}
+
+func sprintValue(v interface{}) string {
+	serialized, err := json.Marshal(v)
+	if err != nil {
+		return err.Error()
+	}
+	return string(serialized)
+}
+
+// vim: noet:ts=4:sw=4:sts=4:spell
@@ -0,0 +1,193 @@
+//go:build go1.21
+// +build go1.21
+
+/*
+ *  b4ck-client
+ *  Copyright 2020 Michał Trojnara
+
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU General Public License as published by
+ *  the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU General Public License for more details.
+
+ *  You should have received a copy of the GNU General Public License
+ *  along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"crypto/tls"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// sessionMaxAge is the maximum lifetime of a TLS 1.3 session ticket
+const sessionMaxAge = 7 * 24 * time.Hour
+
+// sessionSaveDelay batches the sessions added in a burst into one save
+const sessionSaveDelay = time.Second
+
+// PersistentSessionCache is a tls.ClientSessionCache that also saves
+// the sessions to a file, so they can be resumed after a restart
+type PersistentSessionCache struct {
+	tls.ClientSessionCache
+	logger  *Logger
+	path    string
+	mu      sync.Mutex
+	entries map[string]*sessionEntry
+	failed  bool // Saving is disabled after a failure
+	pending bool // A save is scheduled
+
+	saveMu sync.Mutex // Serializes writing the file
+}
+
+type sessionEntry struct {
+	Saved  time.Time
+	Ticket []byte
+	State  []byte
+}
+
+// newSessionCache returns a TLS client session cache, persistent if path is set
+func newSessionCache(logger *Logger, path string, capacity int) tls.ClientSessionCache {
+	cache := NewInstrumentedSessionCache(capacity)
+	if path == "" {
+		return cache
+	}
+	err := checkWritable(path)
+	if err != nil {
+		logger.Warningf("Persistent TLS session cache disabled: %s", err)
+		return cache
+	}
+	p := &PersistentSessionCache{
+		ClientSessionCache: cache,
+		logger:             logger,
+		path:               path,
+		entries:            make(map[string]*sessionEntry),
+	}
+	p.load()
+	return p
+}
+
+// load restores the unexpired sessions, ignoring corrupted entries
+func (p *PersistentSessionCache) load() {
+	data, err := ioutil.ReadFile(p.path)
+	if os.IsNotExist(err) {
+		return
+	}
+	if err != nil {
+		p.logger.Warningf("Failed to read TLS session cache: %s", err)
+		return
+	}
+	var entries map[string]*sessionEntry
+	err = json.Unmarshal(data, &entries)
+	if err != nil {
+		p.logger.Warningf("Ignoring corrupted TLS session cache: %s", err)
+		return
+	}
+	for key, entry := range entries {
+		if entry == nil || time.Since(entry.Saved) > sessionMaxAge {
+			continue
+		}
+		state, err := tls.ParseSessionState(entry.State)
+		if err != nil {
+			p.logger.Debugf("Ignoring corrupted TLS session %s: %s", key, err)
+			continue
+		}
+		session, err := tls.NewResumptionState(entry.Ticket, state)
+		if err != nil {
+			p.logger.Debugf("Ignoring corrupted TLS session %s: %s", key, err)
+			continue
+		}
+		p.ClientSessionCache.Put(key, session)
+		p.entries[key] = entry
+	}
+	p.logger.Infof("Loaded %d TLS sessions", len(p.entries))
+}
+
+// Put adds a session to the cache and schedules saving the cache, away
+// from the TLS handshake
+func (p *PersistentSessionCache) Put(key string, session *tls.ClientSessionState) {
+	p.ClientSessionCache.Put(key, session)
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.failed {
+		return
+	}
+	if session == nil {
+		delete(p.entries, key)
+	} else {
+		ticket, state, err := session.ResumptionState()
+		if err != nil || state == nil {
+			return
+		}
+		data, err := state.Bytes()
+		if err != nil {
+			p.logger.Debugf("Failed to serialize TLS session: %s", err)
+			return
+		}
+		p.entries[key] = &sessionEntry{
+			Saved:  time.Now(),
+			Ticket: ticket,
+			State:  data,
+		}
+	}
+	if !p.pending {
+		p.pending = true
+		time.AfterFunc(sessionSaveDelay, p.flush)
+	}
+}
+
+// flush saves the cache, disabling saving after a failure
+func (p *PersistentSessionCache) flush() {
+	p.saveMu.Lock()
+	defer p.saveMu.Unlock()
+	err := p.save()
+	if err != nil {
+		p.logger.Warningf("Failed to save TLS session cache, persistence disabled: %s", err)
+		p.mu.Lock()
+		p.failed = true
+		p.mu.Unlock()
+	}
+}
+
+// save atomically replaces the cache file with the current sessions
+func (p *PersistentSessionCache) save() error {
+	p.mu.Lock()
+	p.pending = false
+	for key, entry := range p.entries {
+		if time.Since(entry.Saved) > sessionMaxAge {
+			delete(p.entries, key)
+		}
+	}
+	data, err := json.Marshal(p.entries)
+	p.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	file, err := ioutil.TempFile(filepath.Dir(p.path), ".b4ck-sessions-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(file.Name()) // No-op after a successful rename
+	_, err = file.Write(data)
+	if err != nil {
+		file.Close()
+		return err
+	}
+	err = file.Close()
+	if err != nil {
+		return err
+	}
+	return os.Rename(file.Name(), p.path)
+}
+
+// vim: noet:ts=4:sw=4:sts=4:spell
@@ -0,0 +1,62 @@
+//go:build go1.21
+// +build go1.21
+
+/*
+ *  b4ck-client
+ *  Copyright 2020 Michał Trojnara
+
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU General Public License as published by
+ *  the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU General Public License for more details.
+
+ *  You should have received a copy of the GNU General Public License
+ *  along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestSessionCacheSavesInBackground(t *testing.T) {
+	dir, err := ioutil.TempDir("", "b4ck-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "sessions.json")
+	cache := newSessionCache(GetLogger("test"), path, 8)
+
+	// Put only schedules the save
+	cache.Put("key", nil)
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("Cache saved in Put: %v", err)
+	}
+	deadline := time.Now().Add(sessionSaveDelay + 5*time.Second)
+	for {
+		data, err := ioutil.ReadFile(path)
+		if err == nil {
+			if string(data) != "{}" {
+				t.Errorf("Saved %q", data)
+			}
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Cache not saved: %s", err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// vim: noet:ts=4:sw=4:sts=4:spell
@@ -0,0 +1,121 @@
+/*
+ *  b4ck-client
+ *  Copyright 2020 Michał Trojnara
+
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU General Public License as published by
+ *  the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU General Public License for more details.
+
+ *  You should have received a copy of the GNU General Public License
+ *  along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"container/list"
+	"crypto/tls"
+	"sync"
+)
+
+var (
+	metricSessionHits      = metrics.NewCounter("b4ck_tls_session_cache_hits_total", "TLS session cache lookups finding a session")
+	metricSessionMisses    = metrics.NewCounter("b4ck_tls_session_cache_misses_total", "TLS session cache lookups finding no session")
+	metricSessionEvictions = metrics.NewCounter("b4ck_tls_session_cache_evictions_total", "TLS sessions evicted to make room for new ones")
+	metricSessions         = metrics.NewGauge("b4ck_tls_session_cache_size", "TLS sessions in the cache")
+)
+
+// SessionCacheStatus is the TLS session cache usage reported by the admin server
+type SessionCacheStatus struct {
+	Hits      uint64 `json:"hits"`
+	Misses    uint64 `json:"misses"`
+	Evictions uint64 `json:"evictions"`
+	Size      int64  `json:"size"`
+}
+
+// InstrumentedSessionCache is an LRU tls.ClientSessionCache, like the one
+// of tls.NewLRUClientSessionCache, that counts hits, misses and evictions
+type InstrumentedSessionCache struct {
+	mu       sync.Mutex
+	capacity int
+	entries  map[string]*list.Element
+	lru      *list.List // Of *sessionCacheEntry, most recently used first
+}
+
+type sessionCacheEntry struct {
+	key   string
+	state *tls.ClientSessionState
+}
+
+// NewInstrumentedSessionCache returns a cache holding up to capacity sessions
+func NewInstrumentedSessionCache(capacity int) *InstrumentedSessionCache {
+	if capacity < 1 {
+		capacity = 64 // The default of tls.NewLRUClientSessionCache
+	}
+	return &InstrumentedSessionCache{
+		capacity: capacity,
+		entries:  make(map[string]*list.Element),
+		lru:      list.New(),
+	}
+}
+
+// Get returns the session for key, marking it as recently used
+func (c *InstrumentedSessionCache) Get(key string) (*tls.ClientSessionState, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	elem, ok := c.entries[key]
+	if !ok {
+		metricSessionMisses.Inc()
+		return nil, false
+	}
+	metricSessionHits.Inc()
+	c.lru.MoveToFront(elem)
+	return elem.Value.(*sessionCacheEntry).state, true
+}
+
+// Put adds the session for key, or removes it if session is nil
+func (c *InstrumentedSessionCache) Put(key string, session *tls.ClientSessionState) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if elem, ok := c.entries[key]; ok {
+		if session == nil {
+			c.lru.Remove(elem)
+			delete(c.entries, key)
+			metricSessions.Add(-1)
+		} else {
+			elem.Value.(*sessionCacheEntry).state = session
+			c.lru.MoveToFront(elem)
+		}
+		return
+	}
+	if session == nil {
+		return
+	}
+	if c.lru.Len() >= c.capacity {
+		oldest := c.lru.Back()
+		c.lru.Remove(oldest)
+		delete(c.entries, oldest.Value.(*sessionCacheEntry).key)
+		metricSessionEvictions.Inc()
+		metricSessions.Add(-1)
+	}
+	c.entries[key] = c.lru.PushFront(&sessionCacheEntry{key: key, state: session})
+	metricSessions.Add(1)
+}
+
+// sessionCacheStatus returns the current TLS session cache usage
+func sessionCacheStatus() *SessionCacheStatus {
+	return &SessionCacheStatus{
+		Hits:      metricSessionHits.Value(),
+		Misses:    metricSessionMisses.Value(),
+		Evictions: metricSessionEvictions.Value(),
+		Size:      metricSessions.Value(),
+	}
+}
+
+// vim: noet:ts=4:sw=4:sts=4:spell
@@ -0,0 +1,59 @@
+//go:build !windows && !plan9
+// +build !windows,!plan9
+
+/*
+ *  b4ck-client
+ *  Copyright 2020 Michał Trojnara
+
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU General Public License as published by
+ *  the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU General Public License for more details.
+
+ *  You should have received a copy of the GNU General Public License
+ *  along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// handleSignals installs the handlers for runtime control signals
+func (c *Context) handleSignals() {
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGHUP, syscall.SIGUSR2)
+	go func() {
+		for s := range sig {
+			switch s {
+			case syscall.SIGHUP:
+				c.reloadBlocklist()
+			case syscall.SIGUSR2:
+				level := c.logger.CycleLogLevel()
+				c.logger.Infof("Log level changed to %s", level)
+			}
+		}
+	}()
+}
+
+func (c *Context) reloadBlocklist() {
+	if c.blocklist == nil {
+		return
+	}
+	err := c.blocklist.Reload()
+	if err != nil {
+		c.logger.Warningf("Failed to reload blocklist: %s", err)
+		return
+	}
+	c.logger.Infof("Reloaded %d blocklist entries", c.blocklist.Len())
+}
+
+// vim: noet:ts=4:sw=4:sts=4:spell
@@ -0,0 +1,51 @@
+//go:build darwin || dragonfly || freebsd || linux || netbsd || openbsd
+// +build darwin dragonfly freebsd linux netbsd openbsd
+
+/*
+ *  b4ck-client
+ *  Copyright 2020 Michał Trojnara
+
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU General Public License as published by
+ *  the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU General Public License for more details.
+
+ *  You should have received a copy of the GNU General Public License
+ *  along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"syscall"
+)
+
+// dscpControl returns a Dialer.Control function marking sockets with dscp
+func dscpControl(logger *Logger, dscp int) (func(string, string, syscall.RawConn) error, error) {
+	tos := dscp << 2 // DSCP is the upper 6 bits of the ToS/Traffic Class field
+	return func(network, address string, rc syscall.RawConn) error {
+		var err error
+		ctrlErr := rc.Control(func(fd uintptr) {
+			if network == "tcp6" {
+				err = syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IPV6, syscall.IPV6_TCLASS, tos)
+			} else {
+				err = syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IP, syscall.IP_TOS, tos)
+			}
+		})
+		if ctrlErr != nil {
+			err = ctrlErr
+		}
+		if err != nil {
+			// Connect without the marking rather than failing the connection
+			logger.Warningf("Setting DSCP for %s failed: %s", address, err)
+		}
+		return nil
+	}, nil
+}
+
+// vim: noet:ts=4:sw=4:sts=4:spell
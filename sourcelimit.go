@@ -0,0 +1,65 @@
+/*
+ *  b4ck-client
+ *  Copyright 2020 Michał Trojnara
+
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU General Public License as published by
+ *  the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU General Public License for more details.
+
+ *  You should have received a copy of the GNU General Public License
+ *  along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"net"
+	"sync"
+)
+
+// SourceLimit caps the concurrent connections from each source IP address
+type SourceLimit struct {
+	max    int
+	mu     sync.Mutex
+	active map[string]int
+}
+
+// NewSourceLimit returns a new SourceLimit allowing max connections per source
+func NewSourceLimit(max int) *SourceLimit {
+	return &SourceLimit{max: max, active: make(map[string]int)}
+}
+
+// acquire counts a connection from a "host:port" or "host" address, unless
+// the source is at the limit, and returns the function releasing it
+func (l *SourceLimit) acquire(addr string) (func(), bool) {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		host = addr
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		host = ip.String() // Canonical form
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.active[host] >= l.max {
+		return nil, false
+	}
+	l.active[host]++
+	return func() {
+		l.mu.Lock()
+		defer l.mu.Unlock()
+		l.active[host]--
+		if l.active[host] == 0 {
+			delete(l.active, host) // Keep the map small
+		}
+	}, true
+}
+
+// vim: noet:ts=4:sw=4:sts=4:spell
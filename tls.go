@@ -0,0 +1,276 @@
+/*
+ *  b4ck-client
+ *  Copyright 2020 Michał Trojnara
+
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU General Public License as published by
+ *  the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU General Public License for more details.
+
+ *  You should have received a copy of the GNU General Public License
+ *  along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+var (
+	metricHandshakes  = metrics.NewCounter("b4ck_tls_handshakes_total", "Completed TLS handshakes")
+	metricResumed     = metrics.NewCounter("b4ck_tls_resumed_total", "TLS handshakes with a resumed session")
+	metricResumeRate  = metrics.NewGauge("b4ck_tls_resume_rate_percent", "TLS session resumption rate over the alarm window")
+	metricResumeAlarm = metrics.NewGauge("b4ck_tls_resume_alarm", "1 if the TLS session resumption rate is below the threshold")
+)
+
+// CertExpiry tracks the days until the server certificate expires
+type CertExpiry struct {
+	mu       sync.Mutex
+	warnDays int
+	days     int
+	seen     bool
+}
+
+// NewCertExpiry returns a new CertExpiry warning below warnDays
+func NewCertExpiry(warnDays int) *CertExpiry {
+	return &CertExpiry{warnDays: warnDays}
+}
+
+func (e *CertExpiry) get() float64 {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return float64(e.days)
+}
+
+// Check updates the expiry with the server leaf certificate, and logs the
+// days left whenever they change
+func (e *CertExpiry) Check(logger *Logger, state *tls.ConnectionState) {
+	if len(state.PeerCertificates) == 0 {
+		return
+	}
+	notAfter := state.PeerCertificates[0].NotAfter
+	days := int(time.Until(notAfter).Hours() / 24)
+
+	e.mu.Lock()
+	first := !e.seen
+	changed := first || days != e.days
+	e.days, e.seen = days, true
+	e.mu.Unlock()
+	if first { // Exported once known, so that 0 is never reported instead
+		metrics.NewGaugeFunc("b4ck_tls_server_cert_expiry_days",
+			"Days until the server leaf certificate expires", e.get)
+	}
+	if !changed {
+		return
+	}
+	if days < e.warnDays {
+		logger.Warningf("Server certificate expires in %d days (%s)",
+			days, notAfter.UTC().Format(time.RFC3339))
+	} else {
+		logger.Infof("Server certificate expires in %d days (%s)",
+			days, notAfter.UTC().Format(time.RFC3339))
+	}
+}
+
+// ResumeTracker computes the TLS session resumption rate
+// over a window of the most recent handshakes
+type ResumeTracker struct {
+	mu        sync.Mutex
+	threshold float64
+	window    []bool
+	next      int
+	full      bool
+	alarm     bool
+}
+
+// NewResumeTracker returns a new ResumeTracker raising an alarm when
+// the resumption rate over size handshakes drops below threshold
+func NewResumeTracker(threshold float64, size int) *ResumeTracker {
+	return &ResumeTracker{
+		threshold: threshold,
+		window:    make([]bool, size),
+	}
+}
+
+// Record adds a handshake to the window, and reports the current rate
+// and whether the alarm state changed
+func (t *ResumeTracker) Record(resumed bool) (rate float64, changed bool, alarm bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.window[t.next] = resumed
+	t.next = (t.next + 1) % len(t.window)
+	if t.next == 0 {
+		t.full = true
+	}
+	if !t.full { // Not enough data yet
+		return 0, false, t.alarm
+	}
+
+	hits := 0
+	for _, r := range t.window {
+		if r {
+			hits++
+		}
+	}
+	rate = float64(hits) / float64(len(t.window))
+	alarm = rate < t.threshold
+	changed = alarm != t.alarm
+	t.alarm = alarm
+
+	metricResumeRate.Set(int64(rate * 100))
+	if alarm {
+		metricResumeAlarm.Set(1)
+	} else {
+		metricResumeAlarm.Set(0)
+	}
+	return rate, changed, alarm
+}
+
+// recordHandshake updates the TLS session resumption statistics
+func (c *Context) recordHandshake(logger *Logger, resumed bool) {
+	metricHandshakes.Inc()
+	if resumed {
+		metricResumed.Inc()
+	}
+	if c.resumeTracker == nil {
+		return
+	}
+	rate, changed, alarm := c.resumeTracker.Record(resumed)
+	if !changed {
+		return
+	}
+	if alarm {
+		logger.Warningf("TLS session resumption rate dropped to %.0f%%", rate*100)
+	} else {
+		logger.Infof("TLS session resumption rate recovered to %.0f%%", rate*100)
+	}
+}
+
+// cipherSuiteNames maps the cipher suites negotiated in practice to names
+var cipherSuiteNames = map[uint16]string{
+	tls.TLS_AES_128_GCM_SHA256:                  "TLS_AES_128_GCM_SHA256",
+	tls.TLS_AES_256_GCM_SHA384:                  "TLS_AES_256_GCM_SHA384",
+	tls.TLS_CHACHA20_POLY1305_SHA256:            "TLS_CHACHA20_POLY1305_SHA256",
+	tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256: "TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256",
+	tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384: "TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384",
+	tls.TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305:  "TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305",
+	tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256:   "TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256",
+	tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384:   "TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384",
+	tls.TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305:    "TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305",
+}
+
+// handshake performs the TLS handshake, waiting for a free slot if the
+// number of concurrent handshakes is limited
+func (c *Context) handshake(conn *tls.Conn) error {
+	if c.handshakes != nil {
+		c.handshakes <- struct{}{}
+		defer func() { <-c.handshakes }()
+	}
+	if err := c.faults.Handshake(); err != nil {
+		return err
+	}
+	return conn.Handshake()
+}
+
+// cipherSuiteName returns the name of a cipher suite
+func cipherSuiteName(id uint16) string {
+	if name, ok := cipherSuiteNames[id]; ok {
+		return name
+	}
+	return fmt.Sprintf("0x%04X", id)
+}
+
+// tlsVersionName returns the name of a TLS protocol version
+func tlsVersionName(v uint16) string {
+	return fmt.Sprintf("TLSv%d.%d", v>>8-2, v&255-1)
+}
+
+// isNotTLS reports whether a handshake failed because the peer does not
+// speak TLS, as opposed to e.g. a certificate verification failure
+func isNotTLS(err error) bool {
+	var recordErr tls.RecordHeaderError
+	return errors.As(err, &recordErr)
+}
+
+// tlsSummary describes the TLS state of a connection in a few words
+func tlsSummary(conn net.Conn) string {
+	tlsConn, ok := conn.(*tls.Conn)
+	if !ok {
+		return "plaintext"
+	}
+	state := tlsConn.ConnectionState()
+	summary := tlsVersionName(state.Version) + " " + cipherSuiteName(state.CipherSuite)
+	if state.DidResume {
+		summary += " resumed"
+	}
+	return summary
+}
+
+// localTLSReport summarizes a local TLS connection for the server without
+// any key material: version, negotiated protocol and certificate subject
+func localTLSReport(conn net.Conn) string {
+	tlsConn, ok := conn.(*tls.Conn)
+	if !ok {
+		return "LOCAL_PLAINTEXT"
+	}
+	state := tlsConn.ConnectionState()
+	protocol := state.NegotiatedProtocol
+	if protocol == "" {
+		protocol = "none"
+	}
+	subject := "none"
+	if len(state.PeerCertificates) > 0 {
+		subject = state.PeerCertificates[0].Subject.CommonName
+	}
+	return formatTLSReport(tlsVersionName(state.Version), protocol, subject)
+}
+
+// maxTLSReport limits the local TLS report before the truncate suffix;
+// JSON escaping at most doubles the quoted fields, so the info message
+// still fits MaxMsgLen
+const maxTLSReport = 100
+
+// formatTLSReport returns the local TLS report of the given fields
+func formatTLSReport(version, protocol, subject string) string {
+	report := fmt.Sprintf("LOCAL_TLS version=%q protocol=%q subject=%q",
+		version, protocol, subject)
+	if len(report) > maxTLSReport {
+		report = truncate(report, maxTLSReport)
+	}
+	return report
+}
+
+// logConnectionState logs the details of a TLS connection at DEBUG
+func logConnectionState(logger *Logger, state *tls.ConnectionState) {
+	protocol := state.NegotiatedProtocol
+	if protocol == "" {
+		protocol = "none"
+	}
+	logger.Debugf("TLS version: %s", tlsVersionName(state.Version))
+	logger.Debugf("TLS cipher suite: %s", cipherSuiteName(state.CipherSuite))
+	if group := tlsGroupName(state); group != "" {
+		logger.Debugf("TLS key exchange group: %s", group)
+	}
+	logger.Debugf("TLS server name: %s", state.ServerName)
+	logger.Debugf("TLS negotiated protocol: %s", protocol)
+	logger.Debugf("TLS session resumed: %t", state.DidResume)
+	for i, cert := range state.PeerCertificates {
+		logger.Debugf("TLS peer certificate %d: subject %q, issuer %q, expires %s",
+			i, cert.Subject, cert.Issuer, cert.NotAfter.Format(time.RFC3339))
+	}
+	logger.Debugf("TLS OCSP staple: %t", len(state.OCSPResponse) > 0)
+}
+
+// vim: noet:ts=4:sw=4:sts=4:spell
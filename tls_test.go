@@ -0,0 +1,45 @@
+/*
+ *  b4ck-client
+ *  Copyright 2020 Michał Trojnara
+
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU General Public License as published by
+ *  the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU General Public License for more details.
+
+ *  You should have received a copy of the GNU General Public License
+ *  along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"strings"
+	"testing"
+	"unicode/utf8"
+)
+
+func TestTLSReportFitsMessage(t *testing.T) {
+	for _, subject := range []string{
+		"www.example.com",
+		strings.Repeat(`"`, 300),
+		strings.Repeat(`\`, 300),
+		strings.Repeat("é", 300),
+		strings.Repeat("€", 300),
+	} {
+		report := formatTLSReport("TLS 1.3", "h2", subject)
+		if !utf8.ValidString(report) {
+			t.Errorf("Invalid UTF-8 in %q", report)
+		}
+		if _, err := marshalMsg(&Msg{Type: "info", Text: report}); err != nil {
+			t.Errorf("Report of %.20q...: %s", subject, err)
+		}
+	}
+}
+
+// vim: noet:ts=4:sw=4:sts=4:spell
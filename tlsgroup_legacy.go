@@ -0,0 +1,34 @@
+//go:build !go1.25
+// +build !go1.25
+
+/*
+ *  b4ck-client
+ *  Copyright 2020 Michał Trojnara
+
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU General Public License as published by
+ *  the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU General Public License for more details.
+
+ *  You should have received a copy of the GNU General Public License
+ *  along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"crypto/tls"
+)
+
+// tlsGroupName returns an empty string, as the key exchange group is only
+// reported by Go 1.25 or later
+func tlsGroupName(state *tls.ConnectionState) string {
+	return ""
+}
+
+// vim: noet:ts=4:sw=4:sts=4:spell
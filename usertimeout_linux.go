@@ -0,0 +1,52 @@
+//go:build linux
+// +build linux
+
+/*
+ *  b4ck-client
+ *  Copyright 2020 Michał Trojnara
+
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU General Public License as published by
+ *  the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU General Public License for more details.
+
+ *  You should have received a copy of the GNU General Public License
+ *  along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"syscall"
+	"time"
+)
+
+// tcpUserTimeout is TCP_USER_TIMEOUT, missing from the syscall package
+const tcpUserTimeout = 0x12
+
+// userTimeoutControl returns a Dialer.Control function limiting how long
+// transmitted data may remain unacknowledged before the connection fails
+func userTimeoutControl(logger *Logger, timeout time.Duration) (func(string, string, syscall.RawConn) error, error) {
+	ms := int(timeout / time.Millisecond)
+	return func(network, address string, rc syscall.RawConn) error {
+		var err error
+		ctrlErr := rc.Control(func(fd uintptr) {
+			err = syscall.SetsockoptInt(int(fd), syscall.IPPROTO_TCP, tcpUserTimeout, ms)
+		})
+		if ctrlErr != nil {
+			err = ctrlErr
+		}
+		if err != nil {
+			// Connect without the timeout rather than failing the connection
+			logger.Warningf("Setting TCP user timeout for %s failed: %s", address, err)
+		}
+		return nil
+	}, nil
+}
+
+// vim: noet:ts=4:sw=4:sts=4:spell